@@ -23,61 +23,167 @@ package main
 import (
 	"code.google.com/p/go.net/websocket"
 	"encoding/json"
-	"io"
 	"time"
 )
 
 // represents one end of a web socket and has facilities for sending and receiving messages via chans
 type Connection struct {
-	Socket    *websocket.Conn    //the socket that the connection wraps
+	Socket    *websocket.Conn    //the socket the connection was opened with
 	OutChan   chan WorkerMessage // the out box. send messages with c.OutChan<-msg
 	InChan    chan WorkerMessage // the in box. getmsg:=<-c.InChan
 	ReConChan chan WorkerMessage
-	DiedChan  chan int // send died message out on this
-	isWorker  bool     // indicates if this connection is for a worker node
+	DiedChan  chan int                   // send died message out on this
+	isWorker  bool                       // indicates if this connection is for a worker node
+	sockets   chan *websocket.Conn       // holds the socket in use, which changes when a worker reconnects
+	masters   []string                   // addresses a worker connection fails over between
+	master    int                        // index in masters of the master connected to
+	delivery  *Delivery                  // numbers, acknowledges and replays the messages sent and received
+	agreed    *CapabilitySet             // what a worker and its master agreed to use, set by the master's WELCOME
+	reports   chan map[string]*WorkerJob // holds the tasks whose JOBFINISHED or JOBERROR is on OutChan and not yet with the delivery
 }
 
 // Wraps a web socket in a connection starts routines that receive and send messages
 func NewConnection(Socket *websocket.Conn, isWorker bool) *Connection {
+	return newConnection(Socket, isWorker, nil, 0)
+}
+
+// connects a worker to the first of masters that answers.  when the connection drops the worker reconnects to the
+// same master or fails over to the next one that answers.
+func NewWorkerConnection(masters []string) *Connection {
+	ws, index := DialMasters(masters, 0)
+	if ws == nil {
+		logger.Printf("NewWorkerConnection(): no master answered %v", masters)
+		DieIn(0)
+	}
+	return newConnection(ws, true, masters, index)
+}
+
+func newConnection(Socket *websocket.Conn, isWorker bool, masters []string, master int) *Connection {
 	n := Connection{Socket: Socket,
 		OutChan:   make(chan WorkerMessage, conbuffersize),
 		InChan:    make(chan WorkerMessage, conbuffersize),
 		ReConChan: make(chan WorkerMessage, 0),
 		DiedChan:  make(chan int, 1),
-		isWorker:  isWorker}
+		isWorker:  isWorker,
+		sockets:   make(chan *websocket.Conn, 1),
+		masters:   masters,
+		master:    master,
+		delivery:  NewDelivery(),
+		reports:   make(chan map[string]*WorkerJob, 1),
+		agreed:    NewCapabilitySet(nil)}
+	n.sockets <- Socket
+	n.reports <- map[string]*WorkerJob{}
 	go n.GetMsgs()
 	go n.SendMsgs()
 	return &n
 }
 
-// monitor OutChan and sends any messages through web socket usually started in NewConnection
-func (con Connection) SendMsgs() {
+// dials masters in turn, starting with masters[start], until one answers or failoverTimeout seconds have passed.
+// returns the socket, nil if none answered, and the index of the master it is connected to.
+func DialMasters(masters []string, start int) (*websocket.Conn, int) {
+	deadline := time.Now().Add(time.Duration(failoverTimeout) * time.Second)
+	wait := 1
 	for {
-		msg := <-con.OutChan
-
-		msgjson, err := json.Marshal(msg)
-		if err != nil {
-			logger.Warn(err)
-			return
+		for i := 0; i < len(masters); i++ {
+			index := (start + i) % len(masters)
+			if ws := OpenWebSocketToMaster(masters[index]); ws != nil {
+				logger.Printf("connected to master %v", masters[index])
+				return ws, index
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, start
+		}
+		logger.Printf("Attempting reconnect in %v seconds.", wait)
+		<-time.After(time.Duration(wait) * time.Second)
+		if wait < 8 {
+			wait = wait * 2
 		}
+	}
+}
 
-		//try to send over and over.
-		for {
-			if _, err := con.Socket.Write(msgjson); err != nil {
-				logger.Warn(err)
-			} else {
-				break
+// the address of the master a worker connection is connected to, empty on the master's side
+func (con *Connection) MasterHost() string {
+	if len(con.masters) == 0 {
+		return ""
+	}
+	return con.masters[con.master]
+}
+
+// the socket currently in use
+func (con *Connection) socket() *websocket.Conn {
+	ws := <-con.sockets
+	con.sockets <- ws
+	return ws
+}
+
+// swaps in a new socket after reconnecting
+func (con *Connection) setSocket(ws *websocket.Conn) {
+	<-con.sockets
+	con.sockets <- ws
+}
+
+// monitor OutChan and hands messages to the connection's delivery, which sends them once connected and keeps
+// them until they are acknowledged. acks are sent every ackInterval seconds when there is nothing else to send.
+func (con *Connection) SendMsgs() {
+	for {
+		select {
+		case msg := <-con.OutChan:
+			con.delivery.Send(msg)
+			if msg.Type == JOBFINISHED || msg.Type == JOBERROR {
+				if job := NewWorkerJob(msg.Body); job != nil {
+					reports := <-con.reports
+					delete(reports, job.Key())
+					con.reports <- reports
+				}
 			}
-			<-time.After(time.Duration(2) * time.Second)
+		case <-time.After(time.Duration(ackInterval) * time.Second):
+			con.delivery.SendAck()
 		}
+	}
+}
+
+// queues a task's JOBFINISHED or JOBERROR behind what is already on OutChan, such as its output files.  until
+// the delivery has taken it the task is listed by ReportedTasks, so a HELLO sent in between still reports it.
+func (con *Connection) Report(msg WorkerMessage, job *WorkerJob) {
+	reports := <-con.reports
+	reports[job.Key()] = job
+	con.reports <- reports
+	con.OutChan <- msg
+}
+
+// the tasks whose JOBFINISHED or JOBERROR hasn't been acknowledged by the master, including those still on OutChan
+func (con *Connection) ReportedTasks() []*WorkerJob {
+	reports := <-con.reports
+	queued := make([]*WorkerJob, 0, len(reports))
+	for _, job := range reports {
+		queued = append(queued, job)
+	}
+	con.reports <- reports
 
+	// a report leaves con.reports only after the delivery has it, so looking there second misses none
+	seen := map[string]bool{}
+	jobs := make([]*WorkerJob, 0, len(queued))
+	for _, job := range append(queued, con.delivery.UnackedTasks()...) {
+		if !seen[job.Key()] {
+			seen[job.Key()] = true
+			jobs = append(jobs, job)
+		}
 	}
+	return jobs
 }
 
-// monitor web socket and put messages in the InChan usually started in NewConnection
-func (con Connection) GetMsgs() {
+// longest a refused worker waits before saying hello again
+const maxRefusedBackoff = 10 * time.Minute
+
+// monitor web socket and put messages in the InChan usually started in NewConnection. when the socket closes a
+// worker tries to reconnect, the master reports the death on DiedChan.  duplicates of messages already received
+// are dropped, acks are handled here and not passed on.
+func (con *Connection) GetMsgs() {
+	ws := con.socket()
+	decoder := json.NewDecoder(ws)
+	retryIn := time.Second
 	for {
-		decoder := json.NewDecoder(con.Socket)
 		var msg WorkerMessage
 		err := decoder.Decode(&msg)
 		if err != nil {
@@ -85,55 +191,90 @@ func (con Connection) GetMsgs() {
 		}
 
 		switch {
-		case err == io.EOF:
-			remote := con.Socket.RemoteAddr().String()
-			con.Socket.Close()
+		case err != nil && !isDecodeError(err):
+			con.delivery.Detach(ws)
+			ws.Close()
 			if con.isWorker {
 
 				con.DiedChan <- 1
-				msg := <-con.ReConChan
-				msgjson, err := json.Marshal(msg)
+				hello := <-con.ReConChan
+				msgjson, err := json.Marshal(hello)
 				if err != nil {
 					logger.Warn(err)
 				}
 
-				reconnected := false
-
-				for t := 1; t < 16; t = t * 2 {
-
-					logger.Printf("Attempting reconnect in %v seconds.", t)
-					<-time.After(time.Duration(t) * time.Second)
-					logger.Printf("Attempting reconnect now.")
-
-					ws, err := DialWebSocket(remote)
-					if err != nil {
-						logger.Warn(err)
-						continue
+				for {
+					<-time.After(retryIn)
+					next, index := DialMasters(con.masters, con.master)
+					if next == nil {
+						logger.Printf("no master answered for %v seconds", failoverTimeout)
+						DieIn(10)
 					}
 
-					if _, err = ws.Write(msgjson); err != nil {
+					if _, err = next.Write(msgjson); err != nil {
 						logger.Warn(err)
-					} else {
-						reconnected = true
-						con.Socket = ws
-						break
+						next.Close()
+						continue
 					}
-
+					// the answer is read below, on this goroutine
+					con.delivery.AwaitWelcome(next)
+					con.master = index
+					con.setSocket(next)
+					ws = next
+					break
 				}
-				if reconnected != true {
-					DieIn(10)
-				}
-
+				decoder = json.NewDecoder(ws)
+				continue
 			}
 			con.DiedChan <- 1
-			return //TODO: recover
-
-			decoder = json.NewDecoder(con.Socket)
+			return
 		case err != nil:
 			logger.Printf("Connection read error %v", err)
+			// a decoder that hit a syntax error stays stuck on it
+			if _, syntax := err.(*json.SyntaxError); syntax {
+				decoder = json.NewDecoder(ws)
+			}
 			continue
 
 		}
+
+		if !con.delivery.Receive(&msg) {
+			continue
+		}
+		switch {
+		case msg.Type == ACK:
+			continue
+		case msg.Type == WELCOME && con.isWorker:
+			var welcome Welcome
+			if err := json.Unmarshal([]byte(msg.Body), &welcome); err != nil {
+				logger.Warn(err)
+				continue
+			}
+			logger.Printf("welcomed by master [protocol %d, %v]", welcome.Protocol, welcome.Capabilities)
+			con.agreed.Set(welcome.Capabilities)
+			con.delivery.Attach(ws, welcome.Delivery)
+			retryIn = time.Second
+			continue
+		case msg.Type == REFUSED && con.isWorker:
+			// the master may still hold a stale connection of this node, it lets the worker in once that goes quiet
+			if retryIn < time.Duration(checkinInterval)*time.Second {
+				retryIn = time.Duration(checkinInterval) * time.Second
+			} else if retryIn < maxRefusedBackoff {
+				retryIn *= 2
+			}
+			logger.Printf("refused by master %v: %v, trying again in %v", con.MasterHost(), msg.ErrMsg, retryIn)
+			ws.Close()
+			continue
+		}
 		con.InChan <- msg
 	}
 }
+
+// true for errors in a message itself, anything else (EOF, closed or broken socket) means the connection is gone
+func isDecodeError(err error) bool {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return true
+	}
+	return false
+}
@@ -24,6 +24,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -37,12 +38,63 @@ type Submission struct {
 	ErrorChan     chan *WorkerJob
 	FinishedChan  chan *WorkerJob
 	SubmittedChan chan *SubmitedWorkerJob
-	stopChan      chan int
 	doneChan      chan int
+
+	jobId          string
+	owner          string
+	taskTimeout    int
+	constraints    []string
+	preferences    []string
+	queueMu        sync.Mutex // guards the fields below, which track the next task to hand out
+	nextLine       int
+	nextCount      int
+	nextTaskId     int
+	retries        []*retryJob
+	policy         RetryPolicy
+	held           bool // while set no tasks are handed out, e.g. for jobs waiting on prerequisites
+	paused         bool
+	maxConcurrent  int
+	inFlight       int          // tasks handed out that haven't finished, errored or been lost
+	skip           map[int]bool // task ids restored from the journal that must not be handed out as new tasks
+	stopped        bool
+	lastDispatched time.Time
+	blocked        *WorkerJob // first task that was ready to run but found no room on a node
+	blockedSince   time.Time
+
+	recordMu sync.Mutex
+	records  map[int]*TaskRecord // tasks that have been sent to a node, by task id
+
+	outputMu  sync.Mutex
+	outputs   map[string]OutputFile      // output files that have arrived, by path
+	transfers map[string]*outputTransfer // latest attempt at sending each output file, by path
+}
+
+// a failed task waiting to be handed out again
+type retryJob struct {
+	wj        *WorkerJob
+	notBefore time.Time
 }
 
-func NewSubmission(jd JobDetails, tasks []Task, jobChan chan *WorkerJob) *Submission {
+func NewSubmission(jd JobDetails, tasks []Task) *Submission {
 	logger.Debug("NewSubmission(%v)", jd)
+	s := newSubmission(jd, tasks)
+
+	go s.MonitorWorkTasks()
+	go s.WriteCout()
+	go s.WriteCerror()
+
+	if len(jd.Prerequisites) > 0 {
+		s.held = true
+		s.SetState(WAITING, READY)
+	} else {
+		s.SetState(RUNNING, READY)
+	}
+
+	return s
+}
+
+// the state of a submission without the routines that run it, which is all a job that already finished needs
+func newSubmission(jd JobDetails, tasks []Task) *Submission {
 	s := Submission{
 		Details:       make(chan JobDetails, 1),
 		Tasks:         tasks,
@@ -51,38 +103,136 @@ func NewSubmission(jd JobDetails, tasks []Task, jobChan chan *WorkerJob) *Submis
 		ErrorChan:     make(chan *WorkerJob, 1),
 		FinishedChan:  make(chan *WorkerJob, 1),
 		SubmittedChan: make(chan *SubmitedWorkerJob, 1),
-		stopChan:      make(chan int, 3),
-		doneChan:      make(chan int, 0)}
-
+		doneChan:      make(chan int, 0),
+		jobId:         jd.JobId,
+		owner:         jd.Owner,
+		taskTimeout:   jd.TaskTimeout}
+
+	s.policy = jd.Retry
+	s.records = map[int]*TaskRecord{}
+	s.outputs = map[string]OutputFile{}
+	s.transfers = map[string]*outputTransfer{}
+	s.maxConcurrent = jd.MaxConcurrent
+	s.constraints = jd.Constraints
+	s.preferences = jd.Preferences
+	s.lastDispatched = time.Now()
 	s.Details <- jd
+	return &s
+}
 
-	go s.MonitorWorkTasks()
-	go s.WriteCout()
-	go s.WriteCerror()
-	go s.SubmitJobs(jobChan)
+// starts handing out tasks of a job that was waiting for its prerequisites
+func (this *Submission) Release() {
+	logger.Debug("Release(%v)", this.jobId)
+	this.queueMu.Lock()
+	if this.stopped {
+		this.queueMu.Unlock()
+		return
+	}
+	this.held = false
+	this.lastDispatched = time.Now()
+	this.queueMu.Unlock()
 
-	return &s
+	this.SetState(RUNNING, READY)
+}
+
+// records which prerequisites the job is still waiting on
+func (this *Submission) SetWaitingOn(waitingOn []string) {
+	x := <-this.Details
+	x.WaitingOn = waitingOn
+	x.LastModified = time.Now().String()
+	this.Details <- x
 }
 
 // stops running job, returns true if job was still running
 func (this *Submission) Stop() bool {
-	logger.Debug("Stop()")
+	return this.StopWithStatus(STOPPED)
+}
+
+// stops running job and marks it COMPLETE with the given status, returns true if job was still running
+func (this *Submission) StopWithStatus(status string) bool {
+	logger.Debug("Stop(%v)", status)
 	dtls := this.SniffDetails()
 	logger.Debug("Stop(): %v", dtls.JobId)
 
-	if dtls.State == RUNNING {
-		select {
-		case this.stopChan <- 1:
-			this.SetState(COMPLETE, STOPPED)
-			logger.Debug("Stop():%v", this.SniffDetails())
-		case <-time.After(250000000):
-			logger.Printf("Stop(): timeout stopping: %v", dtls.JobId)
-		}
+	if dtls.State == RUNNING || dtls.State == WAITING || dtls.State == PAUSED {
+		this.queueMu.Lock()
+		this.stopped = true
+		taskId := this.nextTaskId
+		this.queueMu.Unlock()
+
+		this.SetState(COMPLETE, status)
+		logger.Printf("submission stopped [%d, %v, %v]", taskId, dtls.JobId, status)
 		return true
 	}
 	return false
 }
 
+// stops handing out tasks of a running job, tasks already on workers finish. returns false if the job wasn't running
+func (this *Submission) Pause() bool {
+	x := <-this.Details
+	if x.State != RUNNING {
+		this.Details <- x
+		return false
+	}
+
+	this.queueMu.Lock()
+	this.paused = true
+	this.queueMu.Unlock()
+
+	x.State = PAUSED
+	x.LastModified = time.Now().String()
+	journal.Details(x)
+	this.Details <- x
+	logger.Printf("submission paused [%v]", this.jobId)
+	return true
+}
+
+// goes on handing out tasks of a paused job from where it left off, returns false if the job wasn't paused
+func (this *Submission) Resume() bool {
+	x := <-this.Details
+	if x.State != PAUSED {
+		this.Details <- x
+		return false
+	}
+
+	this.queueMu.Lock()
+	this.paused = false
+	this.lastDispatched = time.Now()
+	this.queueMu.Unlock()
+
+	x.State = RUNNING
+	x.LastModified = time.Now().String()
+	journal.Details(x)
+	this.Details <- x
+	logger.Printf("submission resumed [%v]", this.jobId)
+	return true
+}
+
+// changes the priority the dispatcher uses for this submission's remaining tasks
+func (this *Submission) SetPriority(priority int) {
+	logger.Debug("SetPriority(%d)", priority)
+	x := <-this.Details
+	x.Priority = priority
+	x.LastModified = time.Now().String()
+	journal.Details(x)
+	this.Details <- x
+}
+
+// flags whether any connected node can run the job's tasks, logging when that changes
+func (this *Submission) SetUnschedulable(unschedulable bool) {
+	x := <-this.Details
+	if x.Unschedulable != unschedulable && x.State != COMPLETE {
+		if unschedulable {
+			logger.Warn("no connected node can run some tasks of " + x.JobId)
+		} else {
+			logger.Printf("job is schedulable again [%v]", x.JobId)
+		}
+		x.Unschedulable = unschedulable
+		x.LastModified = time.Now().String()
+	}
+	this.Details <- x
+}
+
 func (this *Submission) SniffDetails() JobDetails {
 	dtls := <-this.Details
 	this.Details <- dtls
@@ -93,7 +243,7 @@ func (this *Submission) SniffDetails() JobDetails {
 func (this *Submission) MonitorWorkTasks() {
 	logger.Debug("MonitorWorkTasks()")
 	dtls := <-this.Details
-	logFile, err := os.Create(fmt.Sprintf("%v.log.txt", dtls.JobId))
+	logFile, err := os.OpenFile(fmt.Sprintf("%v.log.txt", dtls.JobId), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		logger.Warn(err)
 	}
@@ -103,20 +253,46 @@ func (this *Submission) MonitorWorkTasks() {
 	for {
 		select {
 		case wj := <-this.ErrorChan:
+			attempt := wj.Attempt
+			retried := this.Requeue(wj)
 			dtls := <-this.Details
-			dtls.Progress.Errored = 1 + dtls.Progress.Errored
+			if retried {
+				dtls.Progress.Retried = 1 + dtls.Progress.Retried
+			} else {
+				dtls.Progress.Errored = 1 + dtls.Progress.Errored
+			}
+			if wj.TimedOut {
+				dtls.Progress.TimedOut = 1 + dtls.Progress.TimedOut
+			}
+			dtls.Usage.Add(wj.Result)
 			dtls.LastModified = time.Now().String()
 			this.Details <- dtls
-			fmt.Fprintf(logFile, "ERRORED %v %v %v %v\n", wj.SubId, wj.JobId, wj.LineId, strings.Join(wj.Args, " "))
 
-			logger.Debug("ERROR [%v,%v]", dtls.JobId, dtls.Progress.Errored)
+			if retried {
+				this.TaskStopped(wj, TASK_QUEUED)
+			} else {
+				this.TaskStopped(wj, TASK_ERRORED)
+			}
+
+			if retried {
+				journal.Record(JournalRecord{Type: JOURNAL_RETRY, JobId: wj.SubId, Task: wj})
+				fmt.Fprintf(logFile, "RETRYING %v %v %v %v %v\n", wj.SubId, wj.JobId, wj.LineId, attempt, strings.Join(wj.Args, " "))
+				logger.Debug("RETRY [%v,%v]", dtls.JobId, dtls.Progress.Retried)
+			} else {
+				journal.Record(JournalRecord{Type: JOURNAL_ERROR, JobId: wj.SubId, Task: wj})
+				fmt.Fprintf(logFile, "ERRORED %v %v %v %v\n", wj.SubId, wj.JobId, wj.LineId, strings.Join(wj.Args, " "))
+				logger.Debug("ERROR [%v,%v]", dtls.JobId, dtls.Progress.Errored)
+			}
 
 		case wj := <-this.FinishedChan:
 			dtls := <-this.Details
 			dtls.Progress.Finished = 1 + dtls.Progress.Finished
+			dtls.Usage.Add(wj.Result)
 			dtls.LastModified = time.Now().String()
 			this.Details <- dtls
 
+			this.TaskStopped(wj, TASK_FINISHED)
+			journal.Record(JournalRecord{Type: JOURNAL_FINISH, JobId: wj.SubId, Task: wj})
 			fmt.Fprintf(logFile, "FINISHED %v %v %v %v\n", wj.SubId, wj.JobId, wj.LineId, strings.Join(wj.Args, " "))
 
 			logger.Debug("FINISHED [%v,%v]", dtls.JobId, dtls.Progress.Finished)
@@ -129,7 +305,9 @@ func (this *Submission) MonitorWorkTasks() {
 		if dtls.Progress.isComplete() {
 			fmt.Fprintln(logFile, "COMPLETED")
 			logger.Debug("COMPLETED [%v]", dtls)
-			this.SetState(COMPLETE, SUCCESS)
+			if dtls.State == RUNNING || dtls.State == PAUSED {
+				this.SetState(COMPLETE, SUCCESS)
+			}
 			this.doneChan <- 1
 			this.doneChan <- 1
 			logger.Debug("COMPLETED [%v]: DONE", dtls.JobId)
@@ -138,27 +316,239 @@ func (this *Submission) MonitorWorkTasks() {
 	}
 }
 
-func (this *Submission) SubmitJobs(jobChan chan *WorkerJob) {
-	logger.Debug("SubmitJobs()")
+// hands out the next task of this submission to the node nodeId, returns nil if nothing is ready to run there.
+// retries that are past their backoff go first, then tasks that have not run yet.  online lists the connected nodes
+// and fits reports whether the node has the slots and memory the task asks for, a task that does not fit stays queued.
+func (this *Submission) NextWorkerJob(nodeId string, online []string, fits func(*WorkerJob) bool) *WorkerJob {
+	this.queueMu.Lock()
+	defer this.queueMu.Unlock()
 
-	this.SetState(RUNNING, READY)
+	if this.stopped || this.held || this.paused || this.atConcurrencyLimit() {
+		return nil
+	}
 
-	dtls := this.SniffDetails()
-	taskId := 0
-	for lineId, vals := range this.Tasks {
-		logger.Debug("Submitting [%d,%v]", lineId, vals)
-		for i := 0; i < vals.Count; i++ {
-			select {
-			case jobChan <- &WorkerJob{SubId: dtls.JobId, LineId: lineId, JobId: taskId, Args: vals.Args}:
-				taskId++
-			case <-this.stopChan:
-				logger.Printf("submission stopped [%d, %v]", taskId, dtls.JobId)
-				return //TODO: add indication that we stopped
-			}
+	now := time.Now()
+	for i, r := range this.retries {
+		if now.Before(r.notBefore) || !this.mayRunOn(r.wj, nodeId, online) {
+			continue
 		}
+		if !fits(r.wj) {
+			this.waitForRoom(r.wj, now)
+			continue
+		}
+		this.placed(r.wj)
+		this.retries = append(this.retries[:i], this.retries[i+1:]...)
+		this.lastDispatched = now
+		this.inFlight++
+		// clear what the last attempt reported
+		r.wj.TimedOut = false
+		r.wj.Error = ""
+		r.wj.Result = nil
+		logger.Debug("Resubmitting [%d,%d,%d]", r.wj.LineId, r.wj.JobId, r.wj.Attempt)
+		return r.wj
 	}
-	logger.Printf("tasks submitted [%d, %v]", taskId, dtls.JobId)
 
+	if !this.hasPending() {
+		return nil
+	}
+
+	vals := this.Tasks[this.nextLine]
+	wj := &WorkerJob{SubId: this.jobId, LineId: this.nextLine, JobId: this.nextTaskId, Args: vals.ArgsFor(this.nextCount), Attempt: 1, Timeout: this.taskTimeout,
+		Cpus: vals.Cpus, Memory: vals.Memory, Env: vals.Env, WorkingDir: vals.WorkingDir, IdEnv: vals.IdEnv,
+		Inputs: vals.Inputs, Outputs: vals.Outputs}
+	if !fits(wj) {
+		this.waitForRoom(wj, now)
+		return nil
+	}
+	this.placed(wj)
+	logger.Debug("Submitting [%d,%v]", this.nextLine, vals)
+
+	this.nextCount++
+	this.nextTaskId++
+	this.lastDispatched = now
+	this.inFlight++
+
+	if !this.hasPending() {
+		logger.Printf("tasks submitted [%d, %v]", this.nextTaskId, this.jobId)
+	}
+	return wj
+}
+
+// remembers the first task that was ready to run but found no room on a node, and since when.  must be called with
+// queueMu held
+func (this *Submission) waitForRoom(wj *WorkerJob, now time.Time) {
+	if this.blocked == nil {
+		this.blocked = wj
+		this.blockedSince = now
+	}
+}
+
+// forgets the waiting task once it is handed out, must be called with queueMu held
+func (this *Submission) placed(wj *WorkerJob) {
+	if this.blocked != nil && this.blocked.JobId == wj.JobId {
+		this.blocked = nil
+	}
+}
+
+// the task that has waited longest for room on a node and since when, nil while none is waiting or the job isn't
+// handing out tasks
+func (this *Submission) Blocked() (*WorkerJob, time.Time) {
+	this.queueMu.Lock()
+	defer this.queueMu.Unlock()
+	if this.blocked == nil || this.stopped || this.held || this.paused {
+		return nil, time.Time{}
+	}
+	return this.blocked, this.blockedSince
+}
+
+// records why the job's next task hasn't been placed, empty once it has
+func (this *Submission) SetUnplaced(reason string) {
+	x := <-this.Details
+	if x.Unplaced != reason {
+		x.Unplaced = reason
+		x.LastModified = time.Now().String()
+	}
+	this.Details <- x
+}
+
+// puts a failed task back on the queue if the retry policy allows another attempt, returns false if it failed for good
+func (this *Submission) Requeue(wj *WorkerJob) bool {
+	this.queueMu.Lock()
+	defer this.queueMu.Unlock()
+
+	if wj.Attempt < 1 {
+		wj.Attempt = 1
+	}
+	if this.stopped || wj.Attempt >= this.policy.MaxAttempts {
+		return false
+	}
+
+	backoff := this.policy.BackoffFor(wj.Attempt)
+	wj.Attempt++
+	this.retries = append(this.retries, &retryJob{wj, time.Now().Add(backoff)})
+	return true
+}
+
+// puts a task that was waiting to be retried when the master went down back on the queue.  it keeps the attempt
+// and error it was journaled with and waits out its backoff again.
+func (this *Submission) RequeueRestored(wj *WorkerJob) {
+	this.queueMu.Lock()
+	defer this.queueMu.Unlock()
+
+	if this.stopped {
+		return
+	}
+	this.retries = append(this.retries, &retryJob{wj, time.Now().Add(this.policy.BackoffFor(wj.Attempt - 1))})
+}
+
+// puts a task that never finished, for instance because its node disconnected, back on the queue to run again right away
+func (this *Submission) Return(wj *WorkerJob) {
+	this.queueMu.Lock()
+	defer this.queueMu.Unlock()
+
+	if this.stopped {
+		return
+	}
+	wj.Error = "node lost"
+	this.TaskStopped(wj, TASK_QUEUED)
+	this.retries = append([]*retryJob{&retryJob{wj, time.Now()}}, this.retries...)
+}
+
+// true if there are tasks left to hand out
+func (this *Submission) HasPending() bool {
+	this.queueMu.Lock()
+	defer this.queueMu.Unlock()
+	if this.stopped || this.held || this.paused || this.atConcurrencyLimit() {
+		return false
+	}
+
+	now := time.Now()
+	for _, r := range this.retries {
+		if !now.Before(r.notBefore) {
+			return true
+		}
+	}
+	return this.hasPending()
+}
+
+// true while the job has as many tasks in flight as it may, must be called with queueMu held
+func (this *Submission) atConcurrencyLimit() bool {
+	return this.maxConcurrent > 0 && this.inFlight >= this.maxConcurrent
+}
+
+// frees the in flight slot of a task that finished, errored or was lost with its node
+func (this *Submission) TaskEnded() {
+	this.queueMu.Lock()
+	defer this.queueMu.Unlock()
+	if this.inFlight > 0 {
+		this.inFlight--
+	}
+}
+
+// changes how many tasks of the job may run at once, 0 for no limit
+func (this *Submission) SetMaxConcurrent(maxConcurrent int) {
+	logger.Debug("SetMaxConcurrent(%d)", maxConcurrent)
+	this.queueMu.Lock()
+	this.maxConcurrent = maxConcurrent
+	this.queueMu.Unlock()
+
+	x := <-this.Details
+	x.MaxConcurrent = maxConcurrent
+	x.LastModified = time.Now().String()
+	journal.Details(x)
+	this.Details <- x
+}
+
+// skips past exhausted task lines and tasks restored from the journal, must be called with queueMu held
+func (this *Submission) hasPending() bool {
+	for this.nextLine < len(this.Tasks) {
+		if this.nextCount >= this.Tasks[this.nextLine].Size() {
+			this.nextLine++
+			this.nextCount = 0
+		} else if this.skip[this.nextTaskId] {
+			delete(this.skip, this.nextTaskId)
+			this.nextCount++
+			this.nextTaskId++
+		} else {
+			break
+		}
+	}
+	return this.nextLine < len(this.Tasks)
+}
+
+// with AvoidFailedNode a retry only goes back to a node it failed on once it has failed on every connected node
+func (this *Submission) mayRunOn(wj *WorkerJob, nodeId string, online []string) bool {
+	if !this.policy.AvoidsFailedNode() || !containsString(wj.FailedOn, nodeId) {
+		return true
+	}
+	for _, id := range online {
+		if !containsString(wj.FailedOn, id) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// the submission's priority plus one point for every priorityAging seconds it has waited since it last got a slot
+func (this *Submission) EffectivePriority(now time.Time) (priority int, waitingSince time.Time) {
+	this.queueMu.Lock()
+	waitingSince = this.lastDispatched
+	this.queueMu.Unlock()
+
+	priority = this.SniffDetails().Priority
+	if priorityAging > 0 {
+		priority += int(now.Sub(waitingSince) / (time.Duration(priorityAging) * time.Second))
+	}
+	return
 }
 
 func (this *Submission) WriteCout() {
@@ -172,7 +562,7 @@ func (this *Submission) WriteCout() {
 		select {
 		case msg := <-this.CoutFileChan:
 			if stdOutFile == nil {
-				if stdOutFile, err = os.Create(fmt.Sprintf("%v.out.txt", dtls.JobId)); err != nil {
+				if stdOutFile, err = os.OpenFile(fmt.Sprintf("%v.out.txt", dtls.JobId), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
 					logger.Warn(err)
 				}
 				if stdOutFile != nil {
@@ -205,7 +595,7 @@ func (this *Submission) WriteCerror() {
 		select {
 		case errmsg := <-this.CerrFileChan:
 			if stdErrFile == nil {
-				if stdErrFile, err = os.Create(fmt.Sprintf("%v.err.txt", dtls.JobId)); err != nil {
+				if stdErrFile, err = os.OpenFile(fmt.Sprintf("%v.err.txt", dtls.JobId), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
 					logger.Warn(err)
 				}
 				if stdErrFile != nil {
@@ -233,6 +623,10 @@ func (this *Submission) SetState(state string, status string) {
 	x.State = state
 	x.Status = status
 	x.LastModified = time.Now().String()
+	if state == RUNNING && x.RunningSince == 0 {
+		x.RunningSince = time.Now().Unix()
+	}
+	journal.Details(x)
 	this.Details <- x
 	logger.Debug("SetState(%v,%v):after=%v", state, status, this.SniffDetails())
 }
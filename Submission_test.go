@@ -0,0 +1,52 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"testing"
+)
+
+func TestSubmissionMayRunOn(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		avoid    *bool
+		failedOn []string
+		nodeId   string
+		online   []string
+		want     bool
+	}{
+		{nil, []string{"a"}, "a", []string{"a", "b"}, true},
+		{&no, []string{"a"}, "a", []string{"a", "b"}, true},
+		{&yes, []string{}, "a", []string{"a", "b"}, true},
+		{&yes, []string{"a"}, "b", []string{"a", "b"}, true},
+		{&yes, []string{"a"}, "a", []string{"a", "b"}, false},
+		{&yes, []string{"a"}, "a", []string{"a"}, true},
+		{&yes, []string{"a", "b"}, "a", []string{"a", "b"}, true},
+		{&yes, []string{"a", "b"}, "a", []string{"a", "b", "c"}, false},
+	}
+	for _, test := range tests {
+		s := &Submission{policy: RetryPolicy{AvoidFailedNode: test.avoid}}
+		wj := &WorkerJob{FailedOn: test.failedOn}
+		if got := s.mayRunOn(wj, test.nodeId, test.online); got != test.want {
+			t.Errorf("avoid=%v failed on %v, mayRunOn(%v, online %v) = %v, want %v",
+				test.avoid != nil && *test.avoid, test.failedOn, test.nodeId, test.online, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// a file stored by the master under its sha256 checksum
+type Blob struct {
+	Name     string // the name it was uploaded as, later uploads with the same name replace it
+	Checksum string
+	Size     int64
+}
+
+type BlobList struct {
+	Items         []Blob
+	NumberOfItems int
+}
+
+// content addressed files in a directory, plus an index of the names they were uploaded as
+type BlobStore struct {
+	mu    sync.RWMutex
+	dir   string
+	names map[string]Blob
+}
+
+// opens the blob store in dir, creating it if needed.  uploads left half written by an earlier run are removed.
+func NewBlobStore(dir string) *BlobStore {
+	store := &BlobStore{dir: dir, names: map[string]Blob{}}
+	if err := os.RemoveAll(store.uploadDir()); err != nil {
+		logger.Warn(err)
+	}
+	if err := os.MkdirAll(store.uploadDir(), 0755); err != nil {
+		logger.Warn(err)
+	}
+	if file, err := os.Open(store.indexPath()); err == nil {
+		if err = json.NewDecoder(file).Decode(&store.names); err != nil {
+			logger.Warn(err)
+		}
+		file.Close()
+	}
+	return store
+}
+
+func (this *BlobStore) indexPath() string {
+	return filepath.Join(this.dir, "index.json")
+}
+
+// where uploads are written until their checksum is known, kept apart from the blobs
+func (this *BlobStore) uploadDir() string {
+	return filepath.Join(this.dir, "uploads")
+}
+
+// the file holding the blob with the given checksum
+func (this *BlobStore) Path(checksum string) string {
+	return filepath.Join(this.dir, checksum)
+}
+
+// true if id has the form of a sha256 checksum, 64 lower case hex characters
+func IsChecksum(id string) bool {
+	if len(id) != 2*sha256.Size {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// stores the content of r, under name unless it is empty, returns the blob it was stored as
+func (this *BlobStore) Put(name string, r io.Reader) (blob Blob, err error) {
+	tmp, err := os.Create(filepath.Join(this.uploadDir(), "upload-"+UniqueId()))
+	if err != nil {
+		return
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	blob = Blob{Name: name, Checksum: hex.EncodeToString(hash.Sum(nil)), Size: size}
+	if err = os.Rename(tmp.Name(), this.Path(blob.Checksum)); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	if name == "" {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.names[name] = blob
+	err = this.writeIndex()
+	return
+}
+
+// must be called with mu held
+func (this *BlobStore) writeIndex() error {
+	file, err := os.Create(this.indexPath() + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(file).Encode(this.names)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(this.indexPath()+".tmp", this.indexPath())
+}
+
+// the checksum of a blob given by name or by checksum, anything else in the directory isn't a blob
+func (this *BlobStore) Resolve(nameOrChecksum string) (string, error) {
+	this.mu.RLock()
+	blob, isin := this.names[nameOrChecksum]
+	this.mu.RUnlock()
+	if isin {
+		return blob.Checksum, nil
+	}
+	if !IsChecksum(nameOrChecksum) {
+		return "", fmt.Errorf("no blob %v", nameOrChecksum)
+	}
+	if _, err := os.Stat(this.Path(nameOrChecksum)); err == nil {
+		return nameOrChecksum, nil
+	}
+	return "", fmt.Errorf("no blob %v", nameOrChecksum)
+}
+
+// every named blob
+func (this *BlobStore) List() []Blob {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	items := make([]Blob, 0, len(this.names))
+	for _, blob := range this.names {
+		items = append(items, blob)
+	}
+	return items
+}
+
+// stores files sent along with a job that tasks list as inputs and points the inputs at their blobs
+func (this *BlobStore) StageInputs(frm *multipart.Form, tasks []Task) error {
+	for _, task := range tasks {
+		for i := range task.Inputs {
+			input := &task.Inputs[i]
+			if input.File != "" {
+				files := frm.File[input.File]
+				if len(files) == 0 {
+					return fmt.Errorf("input %v: file %v not sent", input.Name, input.File)
+				}
+				file, err := files[0].Open()
+				if err != nil {
+					return err
+				}
+				blob, err := this.Put("", file)
+				file.Close()
+				if err != nil {
+					return err
+				}
+				input.Blob = blob.Checksum
+				input.File = ""
+			}
+
+			if input.Blob == "" {
+				return fmt.Errorf("input %v: needs a blob or a file", input.Name)
+			}
+			checksum, err := this.Resolve(input.Blob)
+			if err != nil {
+				return err
+			}
+			input.Blob = checksum
+		}
+	}
+	return nil
+}
+
+// rejects inputs sent as files with the job, only the master can store those
+func CheckInputsStaged(tasks []Task) error {
+	for _, task := range tasks {
+		for _, input := range task.Inputs {
+			if input.File != "" {
+				return errors.New("input files must be uploaded to the master's /blobs first, then given by blob")
+			}
+		}
+	}
+	return nil
+}
+
+type MasterBlobController struct {
+	store  *BlobStore
+	apikey string
+}
+
+// GET /blobs
+func (this MasterBlobController) Index(rw http.ResponseWriter) {
+	logger.Debug("Index()")
+	items := this.store.List()
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(BlobList{Items: items, NumberOfItems: len(items)}); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// GET /blobs/checksum-or-name
+func (this MasterBlobController) Find(rw http.ResponseWriter, id string) {
+	logger.Debug("Find(%v)", id)
+	checksum, err := this.store.Resolve(id)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(this.store.Path(checksum))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("x-golem-blob-checksum", checksum)
+	if _, err := io.Copy(rw, file); err != nil {
+		logger.Warn(err)
+	}
+}
+
+// POST /blobs with each file as a part of a multipart form, stored under its file name
+func (this MasterBlobController) Create(rw http.ResponseWriter, r *http.Request) {
+	logger.Debug("Create()")
+	if CheckApiKey(this.apikey, r) == false {
+		http.Error(rw, "api key required in header", http.StatusForbidden)
+		return
+	}
+
+	mpreader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items := make([]Blob, 0)
+	for {
+		part, err := mpreader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if part.FileName() == "" {
+			continue
+		}
+
+		blob, err := this.store.Put(part.FileName(), part)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Printf("stored blob [%v, %v, %d]", blob.Name, blob.Checksum, blob.Size)
+		items = append(items, blob)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(BlobList{Items: items, NumberOfItems: len(items)}); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -47,7 +48,7 @@ func (this MasterJobController) Index(rw http.ResponseWriter) {
 	this.master.subMu.RUnlock()
 	logger.Debug("for loop done")
 
-	jobDetails := JobDetailsList{Items: items, NumberOfItems: len(items)}
+	jobDetails := JobDetailsList{Items: items, NumberOfItems: len(items), Owners: this.master.OwnerShares()}
 	if err := json.NewEncoder(rw).Encode(jobDetails); err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 	}
@@ -66,7 +67,6 @@ func (this MasterJobController) Create(rw http.ResponseWriter, r *http.Request)
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
 	}
-
 	jobId := GetHeader(r, "x-golem-job-preassigned-id", "")
 	if jobId == "" {
 		jobId = UniqueId()
@@ -85,23 +85,85 @@ func (this MasterJobController) Create(rw http.ResponseWriter, r *http.Request)
 	owner := GetHeader(r, "x-golem-job-owner", "Anonymous")
 	label := GetHeader(r, "x-golem-job-label", jobId)
 	jobtype := GetHeader(r, "x-golem-job-type", "Unspecified")
+	priority, err := GetIntHeader(r, "x-golem-job-priority", 0)
+	if err != nil {
+		http.Error(rw, "x-golem-job-priority: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	maxConcurrent, err := GetMaxConcurrent(r)
+	if err != nil {
+		http.Error(rw, "x-golem-job-max-concurrent: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	retry, err := GetRetryPolicy(r)
+	if err != nil {
+		http.Error(rw, "retry policy: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	taskTimeout, jobTimeout, err := GetTimeouts(r)
+	if err != nil {
+		http.Error(rw, "timeout: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prerequisites, condition, err := GetPrerequisites(r, jobId)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	constraints, preferences := GetPlacement(r)
+
+	// staged last, a job refused for its headers leaves no blobs behind
+	if err := this.master.blobs.StageInputs(r.MultipartForm, tasks); err != nil {
+		http.Error(rw, "inputs: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	jd := NewJobDetails(jobId, owner, label, jobtype, TotalTasks(tasks), SCHEDULED, READY)
+	jd.Priority = priority
+	jd.MaxConcurrent = maxConcurrent
+	jd.Sweeps = SweepSummaries(tasks)
+	jd.Retry = retry.WithDefaults(defaultRetryPolicy)
+	jd.TaskTimeout = taskTimeout
+	jd.JobTimeout = jobTimeout
+	jd.Prerequisites = prerequisites
+	jd.Condition = condition
+	jd.WaitingOn = prerequisites
+	jd.Constraints = constraints
+	jd.Preferences = preferences
 
 	logger.Debug("creating: %v", jobId)
+	// the submit record goes first so the details the new submission journals are replayed onto it
 	this.master.subMu.Lock()
-	this.master.subMap[jobId] = NewSubmission(jd, tasks, this.master.jobChan)
+	journal.Record(JournalRecord{Type: JOURNAL_SUBMIT, JobId: jobId, Details: &jd, Tasks: tasks})
+	this.master.subMap[jobId] = NewSubmission(jd, tasks)
 	this.master.subMu.Unlock()
 	logger.Debug("created: %v", jobId)
+	this.master.CheckSchedulable()
+
+	if len(prerequisites) > 0 {
+		go this.master.WaitForPrerequisites(jobId)
+	}
+	// a job waiting on prerequisites starts its job timeout once it is released
+	if jobTimeout > 0 && len(prerequisites) == 0 {
+		go this.master.EnforceJobTimeout(jobId, jobTimeout)
+	}
 
 	if err := json.NewEncoder(rw).Encode(jd); err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 	}
 }
 
-// GET /jobs/id
+// GET /jobs/id or GET /jobs/id/tasks or GET /jobs/id/tasks/state/task-state or GET /jobs/id/tasks/host/hostname
+// or GET /jobs/id/tasks/task-id or GET /jobs/id/files or GET /jobs/id/files/task-id/path
 func (this MasterJobController) Find(rw http.ResponseWriter, id string) {
 	logger.Debug("Find(%v)", id)
+	parts := strings.Split(strings.Trim(id, "/"), "/")
+	id = parts[0]
 	this.master.subMu.RLock()
 	s, isin := this.master.subMap[id]
 	this.master.subMu.RUnlock()
@@ -112,12 +174,62 @@ func (this MasterJobController) Find(rw http.ResponseWriter, id string) {
 		return
 	}
 	logger.Debug("job found: %v", id)
+
+	if len(parts) > 1 {
+		switch parts[1] {
+		case "tasks":
+			this.findTasks(rw, s, parts[2:])
+		case "files":
+			this.findFiles(rw, s, parts[2:])
+		default:
+			http.Error(rw, "GET /jobs/id/tasks or GET /jobs/id/files", http.StatusNotFound)
+		}
+		return
+	}
+
 	if err := json.NewEncoder(rw).Encode(s.SniffDetails()); err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 	}
 }
 
-// POST /jobs/id/stop or POST /jobs/id/kill
+// writes the job's task records, filtered by state or host, or the record of a single task
+func (this MasterJobController) findTasks(rw http.ResponseWriter, s *Submission, filter []string) {
+	logger.Debug("findTasks(%v)", filter)
+	var item interface{}
+	switch {
+	case len(filter) == 0:
+		items := s.TaskRecords(func(rec TaskRecord) bool { return true })
+		item = TaskRecordList{Items: items, NumberOfItems: len(items)}
+	case len(filter) == 2 && filter[0] == "state":
+		items := s.TaskRecords(func(rec TaskRecord) bool { return rec.State == strings.ToUpper(filter[1]) })
+		item = TaskRecordList{Items: items, NumberOfItems: len(items)}
+	case len(filter) == 2 && filter[0] == "host":
+		items := s.TaskRecords(func(rec TaskRecord) bool { return rec.Host == filter[1] || rec.NodeId == filter[1] })
+		item = TaskRecordList{Items: items, NumberOfItems: len(items)}
+	case len(filter) == 1:
+		taskId, err := strconv.Atoi(filter[0])
+		if err != nil {
+			http.Error(rw, "GET /jobs/id/tasks/task-id", http.StatusBadRequest)
+			return
+		}
+		rec, isin := s.TaskRecord(taskId)
+		if !isin {
+			http.Error(rw, fmt.Sprintf("task %d has not been sent to a node", taskId), http.StatusNotFound)
+			return
+		}
+		item = rec
+	default:
+		http.Error(rw, "GET /jobs/id/tasks/state/task-state or GET /jobs/id/tasks/host/hostname", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.NewEncoder(rw).Encode(item); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// POST /jobs/id/stop or POST /jobs/id/kill or POST /jobs/id/pause or POST /jobs/id/resume
+// or POST /jobs/id/priority/new-priority or POST /jobs/id/max-concurrent/new-limit
 func (this MasterJobController) Act(rw http.ResponseWriter, parts []string, r *http.Request) {
 	logger.Debug("Act(%v)", r.URL.Path)
 	if CheckApiKey(this.apikey, r) == false {
@@ -160,6 +272,40 @@ func (this MasterJobController) Act(rw http.ResponseWriter, parts []string, r *h
 			http.Error(rw, "unable to stop", http.StatusExpectationFailed)
 		}
 		this.master.Broadcast(&WorkerMessage{Type: KILL, SubId: jobId})
+	} else if parts[1] == "pause" {
+		logger.Debug("pausing: %v", jobId)
+		if job.Pause() == false {
+			http.Error(rw, "only running jobs can be paused", http.StatusConflict)
+		}
+	} else if parts[1] == "resume" {
+		logger.Debug("resuming: %v", jobId)
+		if job.Resume() == false {
+			http.Error(rw, "only paused jobs can be resumed", http.StatusConflict)
+		}
+	} else if parts[1] == "priority" {
+		if len(parts) < 3 {
+			http.Error(rw, "POST /jobs/id/priority/new-priority", http.StatusBadRequest)
+			return
+		}
+		priority, err := strconv.Atoi(parts[2])
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Debug("reprioritizing: %v, %d", jobId, priority)
+		job.SetPriority(priority)
+	} else if parts[1] == "max-concurrent" {
+		if len(parts) < 3 {
+			http.Error(rw, "POST /jobs/id/max-concurrent/new-limit", http.StatusBadRequest)
+			return
+		}
+		maxConcurrent, err := strconv.Atoi(parts[2])
+		if err != nil || maxConcurrent < 0 {
+			http.Error(rw, "max-concurrent must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		logger.Debug("limiting: %v, %d", jobId, maxConcurrent)
+		job.SetMaxConcurrent(maxConcurrent)
 	} else if parts[1] == "archive" {
 		logger.Debug("archiving: %v", jobId)
 		dtls := job.SniffDetails()
@@ -167,9 +313,12 @@ func (this MasterJobController) Act(rw http.ResponseWriter, parts []string, r *h
 			go func() {
 				<-time.After(time.Duration(900)*time.Second)
 				this.master.subMu.Lock()
-				_, isin := this.master.subMap[jobId]
+				s, isin := this.master.subMap[jobId]
 				if isin {
+					dtls := s.SniffDetails()
+					this.master.archive(jobId, dtls)
 					delete(this.master.subMap, jobId)
+					journal.Record(JournalRecord{Type: JOURNAL_ARCHIVE, JobId: jobId, Details: &dtls})
 				}
 				this.master.subMu.Unlock()
 			}()
@@ -198,15 +347,23 @@ func (this MasterNodeController) Index(rw http.ResponseWriter) {
 	}
 	this.master.nodeMu.RUnlock()
 	logger.Debug("for loop done")
-	workerNodes := WorkerNodeList{Items: items, NumberOfItems: len(items)}
+	workerNodes := WorkerNodeList{Items: items, NumberOfItems: len(items), Owners: this.master.OwnerShares()}
 	if err := json.NewEncoder(rw).Encode(workerNodes); err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 	}
 }
 
-// GET /nodes/id
+// GET /nodes/id or GET /nodes/id/tasks or GET /nodes/registry or GET /nodes/registry/id, the registry includes
+// nodes that are offline
 func (this MasterNodeController) Find(rw http.ResponseWriter, nodeId string) {
 	logger.Debug("Find(%v)", nodeId)
+	parts := strings.Split(strings.Trim(nodeId, "/"), "/")
+	if parts[0] == "registry" {
+		this.findRegistry(rw, parts)
+		return
+	}
+
+	nodeId = parts[0]
 	this.master.nodeMu.RLock()
 	nh, isin := this.master.NodeHandles[nodeId]
 	this.master.nodeMu.RUnlock()
@@ -217,12 +374,25 @@ func (this MasterNodeController) Find(rw http.ResponseWriter, nodeId string) {
 	}
 
 	logger.Debug("node found: %v", nodeId)
+	if len(parts) > 1 {
+		if parts[1] != "tasks" {
+			http.Error(rw, "GET /nodes/id/tasks", http.StatusNotFound)
+			return
+		}
+		items := this.master.NodeTaskRecords(nh)
+		if err := json.NewEncoder(rw).Encode(TaskRecordList{Items: items, NumberOfItems: len(items)}); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
 	if err := json.NewEncoder(rw).Encode(NewWorkerNode(nh)); err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 	}
 }
 
-// POST /nodes/restart or POST /nodes/die or POST /nodes/id/resize/new-size
+// POST /nodes/restart or POST /nodes/die or POST /nodes/id/resize/new-size or POST /nodes/id/drain or
+// POST /nodes/id/drain/shutdown or POST /nodes/id/undrain
 func (this MasterNodeController) Act(rw http.ResponseWriter, parts []string, r *http.Request) {
 	logger.Debug("Act(%v):%v", r.URL.Path, parts)
 
@@ -243,6 +413,16 @@ func (this MasterNodeController) Act(rw http.ResponseWriter, parts []string, r *
 		return
 	}
 
+	if len(parts) < 2 {
+		http.Error(rw, "POST /nodes/id/resize/new-size or POST /nodes/id/drain or POST /nodes/id/undrain", http.StatusBadRequest)
+		return
+	}
+
+	if parts[1] == "drain" || parts[1] == "undrain" {
+		this.drain(rw, parts)
+		return
+	}
+
 	if parts[1] == "resize" {
 		nodeId := parts[0]
 		numberOfThreads, err := strconv.Atoi(parts[2])
@@ -261,5 +441,6 @@ func (this MasterNodeController) Act(rw http.ResponseWriter, parts []string, r *
 		}
 
 		node.ReSize(numberOfThreads)
+		this.master.NodeResized(node, numberOfThreads)
 	}
 }
@@ -57,7 +57,8 @@ func (this ProxyNodeController) Find(rw http.ResponseWriter, nodeId string) {
 	proxy.ServeHTTP(rw, preq)
 }
 
-// POST /nodes/restart or POST /nodes/die or POST /nodes/id/resize/new-size
+// POST /nodes/restart or POST /nodes/die or POST /nodes/id/resize/new-size or POST /nodes/id/drain[/shutdown]
+// or POST /nodes/id/undrain
 func (this ProxyNodeController) Act(rw http.ResponseWriter, parts []string, r *http.Request) {
 	if CheckApiKey(this.apikey, r) == false {
 		http.Error(rw, "api key required in header", http.StatusForbidden)
@@ -25,6 +25,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strconv"
+	"strings"
 )
 
 type ScribeJobController struct {
@@ -61,13 +62,59 @@ func (this ScribeJobController) Create(rw http.ResponseWriter, r *http.Request)
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := CheckInputsStaged(tasks); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	jobId := UniqueId()
 	owner := GetHeader(r, "x-golem-job-owner", "Anonymous")
 	label := GetHeader(r, "x-golem-job-label", jobId)
 	jobtype := GetHeader(r, "x-golem-job-type", "Unspecified")
+	priority, err := GetIntHeader(r, "x-golem-job-priority", 0)
+	if err != nil {
+		http.Error(rw, "x-golem-job-priority: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	maxConcurrent, err := GetMaxConcurrent(r)
+	if err != nil {
+		http.Error(rw, "x-golem-job-max-concurrent: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	retry, err := GetRetryPolicy(r)
+	if err != nil {
+		http.Error(rw, "retry policy: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	taskTimeout, jobTimeout, err := GetTimeouts(r)
+	if err != nil {
+		http.Error(rw, "timeout: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prerequisites, condition, err := GetPrerequisites(r, jobId)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	constraints, preferences := GetPlacement(r)
 
 	job := NewJobDetails(jobId, owner, label, jobtype, TotalTasks(tasks), NEW, READY)
+	job.Priority = priority
+	job.MaxConcurrent = maxConcurrent
+	job.Sweeps = SweepSummaries(tasks)
+	job.Retry = retry
+	job.TaskTimeout = taskTimeout
+	job.JobTimeout = jobTimeout
+	job.Prerequisites = prerequisites
+	job.Condition = condition
+	job.WaitingOn = prerequisites
+	job.Constraints = constraints
+	job.Preferences = preferences
 	if err := this.store.Create(job, tasks); err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
@@ -77,9 +124,17 @@ func (this ScribeJobController) Create(rw http.ResponseWriter, r *http.Request)
 	}
 }
 
-// GET /jobs/id
+// GET /jobs/id, task records and output files (GET /jobs/id/tasks..., GET /jobs/id/files...) are only kept by
+// the master and are proxied to it
 func (this ScribeJobController) Find(rw http.ResponseWriter, id string) {
 	logger.Debug("Find(%v)", id)
+	if strings.Contains(strings.Trim(id, "/"), "/") {
+		preq, _ := http.NewRequest("GET", "/jobs/"+id, nil)
+		proxy := httputil.NewSingleHostReverseProxy(this.target)
+		proxy.ServeHTTP(rw, preq)
+		return
+	}
+
 	jd, err := this.store.Get(id)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
@@ -90,7 +145,7 @@ func (this ScribeJobController) Find(rw http.ResponseWriter, id string) {
 	}
 }
 
-// POST /jobs/id/stop or POST /jobs/id/kill
+// POST /jobs/id/stop or POST /jobs/id/kill or POST /jobs/id/pause or POST /jobs/id/resume
 func (this ScribeJobController) Act(rw http.ResponseWriter, parts []string, r *http.Request) {
 	logger.Debug("Act(%v):%v", r.URL.Path, parts)
 	if CheckApiKey(this.apikey, r) == false {
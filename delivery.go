@@ -0,0 +1,373 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// seconds between acks sent for messages that haven't been acknowledged by a message going the other way
+const ackInterval = 5
+
+// seconds a worker waits for the master to answer its HELLO before taking it for a master that predates WELCOME
+const welcomeTimeout = 10
+
+// what each end of a connection tells the other when a worker says hello (in HelloMsgBody) and when the master
+// answers (in Welcome), so they can pick up where they left off after a reconnect
+type Handshake struct {
+	Session  string // changes when the sending process restarts, so the receiver knows to start counting over
+	Received int64  // seq of the last message received from the other end
+	Base     int64  // seq before the first message that will be sent or replayed
+}
+
+// numbers the messages sent over a connection, keeps them until the other end acknowledges them so they can be
+// replayed after a reconnect, and drops messages received twice.  a worker keeps its Delivery across reconnects,
+// the master hands it from a node's old connection to its new one.
+type Delivery struct {
+	mu          sync.Mutex
+	session     string
+	nextSeq     int64           // seq of the last message numbered
+	unacked     []WorkerMessage // sent, or waiting to be sent, and not yet acknowledged
+	received    int64           // seq of the last message received
+	acked       int64           // received as of the last message sent
+	peerSession string
+	ws          *websocket.Conn // where messages are written, nil while disconnected or before the handshake
+	forward     *Delivery       // the delivery of the node's new connection, once this one has been handed over
+	legacy      bool            // the other end doesn't number or acknowledge messages, so they are only kept while disconnected
+	greeted     *websocket.Conn // the socket the worker's latest HELLO went out on, until the master answers it
+}
+
+func NewDelivery() *Delivery {
+	return &Delivery{session: UniqueId(), unacked: make([]WorkerMessage, 0)}
+}
+
+// HELLO, ACK and the master's answers to HELLO aren't numbered, they belong to one socket and are never replayed
+func sequenced(msg *WorkerMessage) bool {
+	return msg.Type != HELLO && msg.Type != ACK && msg.Type != WELCOME && msg.Type != REFUSED
+}
+
+// numbers the message, keeps it until it is acknowledged and writes it if connected
+func (d *Delivery) Send(msg WorkerMessage) {
+	d.mu.Lock()
+	if d.forward != nil {
+		forward := d.forward
+		d.mu.Unlock()
+		forward.Send(msg)
+		return
+	}
+	defer d.mu.Unlock()
+
+	if sequenced(&msg) && !d.legacy {
+		d.nextSeq++
+		msg.Seq = d.nextSeq
+		d.unacked = append(d.unacked, msg)
+	}
+	written := d.ws != nil && d.write(msg)
+	if sequenced(&msg) && d.legacy && !written {
+		// nothing acknowledges it, so it is only kept until it can be written after the next handshake
+		d.unacked = append(d.unacked, msg)
+	}
+}
+
+// sends an ACK if messages have arrived since the last message sent
+func (d *Delivery) SendAck() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.forward == nil && d.ws != nil && d.received > d.acked {
+		d.write(WorkerMessage{Type: ACK})
+	}
+}
+
+// writes msg with the latest ack, on error the socket is given up on until the next handshake. d.mu must be held.
+func (d *Delivery) write(msg WorkerMessage) bool {
+	msg.Ack = d.received
+	msgjson, err := json.Marshal(msg)
+	if err != nil {
+		logger.Warn(err)
+		return true
+	}
+	if _, err := d.ws.Write(msgjson); err != nil {
+		logger.Warn(err)
+		d.ws = nil
+		return false
+	}
+	d.acked = msg.Ack
+	return true
+}
+
+// drops acknowledged messages.  d.mu must be held.
+func (d *Delivery) trim(ack int64) {
+	n := 0
+	for n < len(d.unacked) && d.unacked[n].Seq <= ack {
+		n++
+	}
+	d.unacked = d.unacked[n:]
+}
+
+// takes the other end's ack from a message, returns false if the message is a duplicate to be dropped
+func (d *Delivery) Receive(msg *WorkerMessage) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if msg.Ack > 0 {
+		d.trim(msg.Ack)
+	}
+	if msg.Seq == 0 {
+		return true
+	}
+	if msg.Seq <= d.received {
+		logger.Debug("Receive(): dropping duplicate message %d", msg.Seq)
+		return false
+	}
+	if msg.Seq > d.received+1 {
+		logger.Printf("Receive(): messages %d to %d missing", d.received+1, msg.Seq-1)
+	}
+	d.received = msg.Seq
+	return true
+}
+
+// this end's half of the handshake
+func (d *Delivery) Handshake() Handshake {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.handshake()
+}
+
+// d.mu must be held
+func (d *Delivery) handshake() Handshake {
+	base := d.nextSeq
+	if len(d.unacked) > 0 {
+		base = d.unacked[0].Seq - 1
+	}
+	return Handshake{Session: d.session, Received: d.received, Base: base}
+}
+
+// a new process on the other end numbers its messages from scratch.  d.mu must be held.
+func (d *Delivery) meet(peer Handshake) {
+	if peer.Session != d.peerSession {
+		d.peerSession = peer.Session
+		d.received = peer.Base
+		d.acked = 0
+	}
+	d.trim(peer.Received)
+}
+
+// writes every message not yet acknowledged, in order, and connects the delivery to ws.  d.mu must be held.
+func (d *Delivery) replay(ws *websocket.Conn) {
+	d.ws = ws
+	logger.Debug("replay(): %d messages", len(d.unacked))
+	for _, msg := range d.unacked {
+		if !d.write(msg) {
+			return
+		}
+	}
+}
+
+// the worker's side of the handshake, given the master's answer to its HELLO.  peer is nil for a master that
+// doesn't number messages.
+func (d *Delivery) Attach(ws *websocket.Conn, peer *Handshake) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.greeted = nil
+	if peer == nil {
+		d.legacy = true
+		d.flush(ws)
+		return
+	}
+	d.legacy = false
+	d.meet(*peer)
+	d.replay(ws)
+}
+
+// the worker's side of the handshake with a master that never answers HELLO because it predates WELCOME, called
+// before the master can answer the HELLO sent on ws.  if no answer has come after welcomeTimeout seconds, what is
+// waiting is written as is and from then on messages are written without being kept, the way such a master expects.
+func (d *Delivery) AwaitWelcome(ws *websocket.Conn) {
+	d.mu.Lock()
+	d.greeted = ws
+	d.mu.Unlock()
+	go d.welcomeTimedOut(ws)
+}
+
+func (d *Delivery) welcomeTimedOut(ws *websocket.Conn) {
+	<-time.After(time.Duration(welcomeTimeout) * time.Second)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.greeted != ws {
+		return
+	}
+	logger.Printf("AwaitWelcome(): no answer to HELLO in %d secs, taking the master for one that predates WELCOME", welcomeTimeout)
+	d.greeted = nil
+	d.legacy = true
+	d.flush(ws)
+}
+
+// connects a delivery that doesn't number messages to ws and writes what was kept while it was disconnected,
+// forgetting each message once written.  d.mu must be held.
+func (d *Delivery) flush(ws *websocket.Conn) {
+	d.ws = ws
+	logger.Debug("flush(): %d messages", len(d.unacked))
+	for len(d.unacked) > 0 {
+		if !d.write(d.unacked[0]) {
+			return
+		}
+		d.unacked = d.unacked[1:]
+	}
+}
+
+// the master's side of the handshake, given the worker's HELLO.  if the worker is the same process that was
+// connected as previous, the new connection carries on previous's numbering.  the master answers with its own
+// handshake in its WELCOME and then replays what the worker hasn't acknowledged.  peer is nil for workers that
+// don't number their messages.
+func (d *Delivery) Accept(ws *websocket.Conn, peer *Handshake, previous *Delivery, welcome Welcome) {
+	if previous != nil {
+		session := ""
+		if peer != nil {
+			session = peer.Session
+		}
+		previous.handOver(d, session)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ws = ws
+	answer := WorkerMessage{Type: WELCOME}
+	if peer == nil {
+		d.legacy = true
+		answer.BodyFromInterface(welcome)
+		if d.write(answer) {
+			d.flush(ws)
+		}
+		return
+	}
+
+	d.meet(*peer)
+	handshake := d.handshake()
+	welcome.Delivery = &handshake
+	answer.BodyFromInterface(welcome)
+	if d.write(answer) {
+		d.replay(ws)
+	}
+}
+
+// moves the numbering and unacknowledged messages over to next if next is talking to the same worker process,
+// and from then on forwards anything sent here to next
+func (d *Delivery) handOver(next *Delivery, peerSession string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ws = nil
+	d.forward = next
+	if d.peerSession != peerSession || d.peerSession == "" {
+		return
+	}
+
+	next.mu.Lock()
+	defer next.mu.Unlock()
+	unacked := d.unacked
+	nextSeq := d.nextSeq
+	for _, msg := range next.unacked {
+		nextSeq++
+		msg.Seq = nextSeq
+		unacked = append(unacked, msg)
+	}
+	next.session = d.session
+	next.nextSeq = nextSeq
+	next.unacked = unacked
+	next.received = d.received
+	next.peerSession = d.peerSession
+	d.unacked = nil
+}
+
+// stops writing to ws, if it is still the socket in use
+func (d *Delivery) Detach(ws *websocket.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ws == ws {
+		d.ws = nil
+	}
+	if d.greeted == ws {
+		d.greeted = nil
+	}
+}
+
+// the tasks whose JOBFINISHED or JOBERROR hasn't been acknowledged, so they are still reported as running
+func (d *Delivery) UnackedTasks() []*WorkerJob {
+	return d.unackedJobs(JOBFINISHED, JOBERROR)
+}
+
+// the tasks whose START hasn't been acknowledged, after a handover they are replayed to the worker
+func (d *Delivery) UnackedStarts() []*WorkerJob {
+	return d.unackedJobs(START)
+}
+
+func (d *Delivery) unackedJobs(types ...int) []*WorkerJob {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	jobs := make([]*WorkerJob, 0)
+	for _, msg := range d.unacked {
+		for _, t := range types {
+			if msg.Type == t {
+				if job := NewWorkerJob(msg.Body); job != nil {
+					jobs = append(jobs, job)
+				}
+			}
+		}
+	}
+	return jobs
+}
+
+// writes a HELLO, or the master's REFUSED answer to one, straight to the socket, ahead of anything waiting to
+// be delivered
+func (con *Connection) SendDirect(msg WorkerMessage) error {
+	msgjson, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = con.socket().Write(msgjson)
+	return err
+}
+
+// true if hello comes from the worker process this connection has been talking to, rather than another worker
+// presenting the same node id.  a worker that doesn't number its messages can't be told apart, so it never is.
+func (con *Connection) SameWorker(hello *HelloMsgBody) bool {
+	if hello.Delivery == nil || hello.Delivery.Session == "" {
+		return false
+	}
+	con.delivery.mu.Lock()
+	defer con.delivery.mu.Unlock()
+	return con.delivery.peerSession == hello.Delivery.Session
+}
+
+// the master's side of the handshake once the worker has said hello and the protocol and capabilities to use
+// have been agreed, previous is the node's last connection
+func (con *Connection) Accept(hello *HelloMsgBody, previous *Connection, welcome Welcome) {
+	var prev *Delivery
+	if previous != nil {
+		prev = previous.delivery
+	}
+	peer := hello.Delivery
+	if !hasCapability(welcome.Capabilities, CAP_DELIVERY) {
+		peer = nil
+	}
+	con.delivery.Accept(con.socket(), peer, prev, welcome)
+}
@@ -0,0 +1,293 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a connected pair of web sockets, the delivery under test writes to near and far reads what it wrote
+func socketPair(t *testing.T) (near *websocket.Conn, far *json.Decoder, closeAll func()) {
+	accepted := make(chan *websocket.Conn)
+	done := make(chan int)
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		accepted <- ws
+		<-done
+	}))
+	near, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http"), "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := <-accepted
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return near, json.NewDecoder(ws), func() {
+		near.Close()
+		close(done)
+		server.Close()
+	}
+}
+
+// the seqs of the next n messages read from far
+func readSeqs(t *testing.T, far *json.Decoder, n int) []int64 {
+	seqs := make([]int64, 0, n)
+	for i := 0; i < n; i++ {
+		var msg WorkerMessage
+		if err := far.Decode(&msg); err != nil {
+			t.Fatalf("reading message %d of %d: %v", i+1, n, err)
+		}
+		seqs = append(seqs, msg.Seq)
+	}
+	return seqs
+}
+
+func seqsOf(msgs []WorkerMessage) []int64 {
+	seqs := make([]int64, 0, len(msgs))
+	for _, msg := range msgs {
+		seqs = append(seqs, msg.Seq)
+	}
+	return seqs
+}
+
+func keysOf(jobs []*WorkerJob) []string {
+	keys := make([]string, 0, len(jobs))
+	for _, job := range jobs {
+		keys = append(keys, job.Key())
+	}
+	return keys
+}
+
+func jobMessage(msgType int, subId string, jobId int) WorkerMessage {
+	msg := WorkerMessage{Type: msgType, SubId: subId}
+	msg.BodyFromInterface(WorkerJob{SubId: subId, JobId: jobId})
+	return msg
+}
+
+func TestDeliverySend(t *testing.T) {
+	tests := []struct {
+		legacy bool
+		types  []int
+		want   []int64 // seqs of the messages kept while disconnected
+	}{
+		{false, []int{START, KILL, COUT}, []int64{1, 2, 3}},
+		{false, []int{HELLO, CHECKIN, ACK, JOBFINISHED}, []int64{1, 2}},
+		{false, []int{WELCOME, REFUSED}, []int64{}},
+		{true, []int{START, HELLO, KILL}, []int64{0, 0}},
+	}
+	for _, test := range tests {
+		d := NewDelivery()
+		d.legacy = test.legacy
+		for _, msgType := range test.types {
+			d.Send(WorkerMessage{Type: msgType})
+		}
+		if got := seqsOf(d.unacked); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("legacy=%v Send(%v) kept %v, want %v", test.legacy, test.types, got, test.want)
+		}
+	}
+}
+
+func TestDeliveryReceive(t *testing.T) {
+	d := NewDelivery()
+	for i := 0; i < 3; i++ {
+		d.Send(WorkerMessage{Type: START})
+	}
+
+	steps := []struct {
+		seq     int64
+		ack     int64
+		want    bool
+		unacked int
+	}{
+		{1, 0, true, 3},
+		{1, 0, false, 3},
+		{2, 1, true, 2},
+		{0, 2, true, 1},
+		{5, 2, true, 1},
+		{3, 3, false, 0},
+		{6, 9, true, 0},
+	}
+	for _, step := range steps {
+		if got := d.Receive(&WorkerMessage{Type: COUT, Seq: step.seq, Ack: step.ack}); got != step.want {
+			t.Errorf("Receive(seq %d, ack %d) = %v, want %v", step.seq, step.ack, got, step.want)
+		}
+		if len(d.unacked) != step.unacked {
+			t.Errorf("after Receive(seq %d, ack %d) %d unacked, want %d", step.seq, step.ack, len(d.unacked), step.unacked)
+		}
+	}
+}
+
+func TestDeliveryMeet(t *testing.T) {
+	tests := []struct {
+		peer     Handshake
+		received int64
+		unacked  []int64
+		base     int64
+	}{
+		{Handshake{Session: "a", Received: 0, Base: 0}, 4, []int64{1, 2, 3}, 0},
+		{Handshake{Session: "a", Received: 2, Base: 0}, 4, []int64{3}, 2},
+		{Handshake{Session: "b", Received: 0, Base: 7}, 7, []int64{1, 2, 3}, 0},
+		{Handshake{Session: "b", Received: 3, Base: 0}, 0, []int64{}, 3},
+	}
+	for _, test := range tests {
+		d := NewDelivery()
+		for i := 0; i < 3; i++ {
+			d.Send(WorkerMessage{Type: START})
+		}
+		d.peerSession = "a"
+		d.received = 4
+
+		d.mu.Lock()
+		d.meet(test.peer)
+		handshake := d.handshake()
+		d.mu.Unlock()
+
+		if d.received != test.received {
+			t.Errorf("meet(%+v) received = %d, want %d", test.peer, d.received, test.received)
+		}
+		if got := seqsOf(d.unacked); !reflect.DeepEqual(got, test.unacked) {
+			t.Errorf("meet(%+v) unacked = %v, want %v", test.peer, got, test.unacked)
+		}
+		if handshake.Base != test.base || handshake.Received != test.received || handshake.Session != d.session {
+			t.Errorf("meet(%+v) handshake = %+v, want base %d", test.peer, handshake, test.base)
+		}
+	}
+}
+
+func TestDeliveryReplay(t *testing.T) {
+	tests := []struct {
+		received int64 // as the other end reports in its handshake
+		want     []int64
+	}{
+		{0, []int64{1, 2, 3, 4}},
+		{2, []int64{3, 4}},
+		{3, []int64{4}},
+	}
+	for _, test := range tests {
+		near, far, closeAll := socketPair(t)
+		d := NewDelivery()
+		for i := 0; i < 3; i++ {
+			d.Send(WorkerMessage{Type: START})
+		}
+		d.Attach(near, &Handshake{Session: "master", Received: test.received})
+		d.Send(WorkerMessage{Type: COUT})
+
+		if got := readSeqs(t, far, len(test.want)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Attach() after %d received replayed %v, want %v", test.received, got, test.want)
+		}
+		closeAll()
+	}
+}
+
+func TestDeliveryLegacy(t *testing.T) {
+	near, far, closeAll := socketPair(t)
+	defer closeAll()
+
+	d := NewDelivery()
+	d.Send(WorkerMessage{Type: COUT})
+	d.Send(WorkerMessage{Type: JOBFINISHED})
+	d.Attach(near, nil)
+	d.Send(WorkerMessage{Type: CERROR})
+	// numbered before the master turned out not to number messages, which such a master ignores
+	if got := readSeqs(t, far, 3); !reflect.DeepEqual(got, []int64{1, 2, 0}) {
+		t.Errorf("legacy delivery wrote seqs %v, want [1 2 0]", got)
+	}
+	if len(d.unacked) != 0 {
+		t.Errorf("legacy delivery kept %d written messages, want 0", len(d.unacked))
+	}
+
+	d.Detach(near)
+	d.Send(WorkerMessage{Type: COUT})
+	if len(d.unacked) != 1 {
+		t.Errorf("legacy delivery kept %d messages sent while detached, want 1", len(d.unacked))
+	}
+}
+
+func TestDeliveryHandOver(t *testing.T) {
+	tests := []struct {
+		previous string // the worker session the old connection talked to
+		peer     string // the worker session of the new connection
+		unacked  []int64
+		received int64
+	}{
+		{"w1", "w1", []int64{1, 2, 3, 4}, 6},
+		{"w1", "w2", []int64{1, 2}, 0},
+		{"", "", []int64{1, 2}, 0},
+	}
+	for _, test := range tests {
+		previous := NewDelivery()
+		previous.peerSession = test.previous
+		previous.received = 6
+		previous.Send(WorkerMessage{Type: START})
+		previous.Send(WorkerMessage{Type: KILL})
+
+		next := NewDelivery()
+		next.Send(WorkerMessage{Type: START})
+		next.Send(WorkerMessage{Type: START})
+
+		previous.handOver(next, test.peer)
+		if got := seqsOf(next.unacked); !reflect.DeepEqual(got, test.unacked) {
+			t.Errorf("handOver(%v to %v) unacked = %v, want %v", test.previous, test.peer, got, test.unacked)
+		}
+		if next.received != test.received {
+			t.Errorf("handOver(%v to %v) received = %d, want %d", test.previous, test.peer, next.received, test.received)
+		}
+		if carried := next.session == previous.session; carried != (test.received > 0) {
+			t.Errorf("handOver(%v to %v) carried the session over = %v", test.previous, test.peer, carried)
+		}
+
+		previous.Send(WorkerMessage{Type: KILL})
+		if len(next.unacked) != len(test.unacked)+1 {
+			t.Errorf("handOver(%v to %v) didn't forward a later message", test.previous, test.peer)
+		}
+	}
+}
+
+func TestDeliveryUnackedJobs(t *testing.T) {
+	d := NewDelivery()
+	d.Send(jobMessage(START, "a", 1))
+	d.Send(jobMessage(JOBFINISHED, "a", 2))
+	d.Send(jobMessage(JOBERROR, "a", 3))
+	d.Send(WorkerMessage{Type: COUT, Body: "a line"})
+	d.Send(jobMessage(START, "a", 4))
+
+	tests := []struct {
+		ack    int64
+		starts []string
+		tasks  []string
+	}{
+		{0, []string{"a/1", "a/4"}, []string{"a/2", "a/3"}},
+		{2, []string{"a/4"}, []string{"a/3"}},
+		{5, []string{}, []string{}},
+	}
+	for _, test := range tests {
+		d.Receive(&WorkerMessage{Type: ACK, Ack: test.ack})
+		if got := keysOf(d.UnackedStarts()); !reflect.DeepEqual(got, test.starts) {
+			t.Errorf("ack %d UnackedStarts() = %v, want %v", test.ack, got, test.starts)
+		}
+		if got := keysOf(d.UnackedTasks()); !reflect.DeepEqual(got, test.tasks) {
+			t.Errorf("ack %d UnackedTasks() = %v, want %v", test.ack, got, test.tasks)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"time"
+)
+
+// true if a completed prerequisite job ended the way condition asks for
+func (this JobDetails) MeetsCondition(condition string) bool {
+	switch condition {
+	case AFTER_COMPLETION:
+		return true
+	case AFTER_FAILURE:
+		return this.Failed()
+	}
+	return this.Succeeded()
+}
+
+// looks up a job the master is running or has archived, returns false if the master has never seen it
+func (m *Master) FindJobDetails(jobId string) (JobDetails, bool) {
+	m.subMu.RLock()
+	defer m.subMu.RUnlock()
+	if s, isin := m.subMap[jobId]; isin && s != nil {
+		return s.SniffDetails(), true
+	}
+	dtls, isin := m.archived[jobId]
+	return dtls, isin
+}
+
+// keeps the final details of an archived job for jobs that depend on it, forgetting the oldest past
+// maxArchived.  m.subMu must be held.
+func (m *Master) archive(jobId string, dtls JobDetails) {
+	if _, isin := m.archived[jobId]; !isin {
+		m.archiveList = append(m.archiveList, jobId)
+	}
+	m.archived[jobId] = dtls
+	for len(m.archiveList) > maxArchived {
+		delete(m.archived, m.archiveList[0])
+		m.archiveList = m.archiveList[1:]
+	}
+}
+
+// holds a job in WAITING until every prerequisite has completed, then releases it and starts its job timeout.  a
+// prerequisite the master hasn't seen yet is waited for, since the scribe may not have posted it, but only for
+// prerequisiteWait seconds before the job is cancelled.  as soon as a prerequisite completes in a way that can't
+// satisfy the job's condition the job is cancelled, which in turn cancels jobs waiting on it.
+func (m *Master) WaitForPrerequisites(jobId string) {
+	logger.Debug("WaitForPrerequisites(%v)", jobId)
+	deadline := time.Now().Add(time.Duration(prerequisiteWait) * time.Second)
+	for {
+		s := m.GetSub(jobId)
+		if s == nil {
+			return
+		}
+		dtls := s.SniffDetails()
+		if dtls.State != WAITING {
+			logger.Debug("WaitForPrerequisites(%v): no longer waiting [%v]", jobId, dtls.State)
+			return
+		}
+
+		waitingOn := make([]string, 0, len(dtls.Prerequisites))
+		unknown := make([]string, 0)
+		for _, prereq := range dtls.Prerequisites {
+			pd, known := m.FindJobDetails(prereq)
+			if !known {
+				unknown = append(unknown, prereq)
+			}
+			if !known || pd.State != COMPLETE {
+				waitingOn = append(waitingOn, prereq)
+				continue
+			}
+			if !pd.MeetsCondition(dtls.Condition) {
+				logger.Printf("cancelling %v: prerequisite %v ended %v, condition %v", jobId, prereq, pd.Status, dtls.Condition)
+				s.SetWaitingOn([]string{prereq})
+				s.StopWithStatus(CANCELLED)
+				return
+			}
+		}
+
+		if len(unknown) > 0 && time.Now().After(deadline) {
+			logger.Printf("cancelling %v: prerequisites %v unknown after %d secs", jobId, unknown, prerequisiteWait)
+			s.SetWaitingOn(unknown)
+			s.StopWithStatus(CANCELLED)
+			return
+		}
+
+		s.SetWaitingOn(waitingOn)
+		if len(waitingOn) == 0 {
+			logger.Printf("prerequisites met, releasing %v", jobId)
+			s.Release()
+			if dtls.JobTimeout > 0 {
+				go m.EnforceJobTimeout(jobId, dtls.JobTimeout)
+			}
+			return
+		}
+		<-time.After(5 * time.Second)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMeetsCondition(t *testing.T) {
+	tests := []struct {
+		status     string
+		errored    int
+		success    bool
+		completion bool
+		failure    bool
+	}{
+		{SUCCESS, 0, true, true, false},
+		{SUCCESS, 2, false, true, true},
+		{TIMEOUT, 0, false, true, true},
+		{STOPPED, 0, false, true, false},
+		{STOPPED, 2, false, true, false},
+		{CANCELLED, 0, false, true, false},
+	}
+	for _, test := range tests {
+		dtls := NewJobDetails("prereq", "owner", "prereq", "test", 4, COMPLETE, test.status)
+		dtls.Progress.Errored = test.errored
+		want := map[string]bool{AFTER_SUCCESS: test.success, AFTER_COMPLETION: test.completion, AFTER_FAILURE: test.failure}
+		for condition, met := range want {
+			if got := dtls.MeetsCondition(condition); got != met {
+				t.Errorf("%v with %d errored MeetsCondition(%v) = %v, want %v", test.status, test.errored, condition, got, met)
+			}
+		}
+	}
+}
+
+func TestFindJobDetails(t *testing.T) {
+	defer func(kept int) { maxArchived = kept }(maxArchived)
+	maxArchived = 2
+
+	running := NewJobDetails("running", "owner", "running", "test", 1, RUNNING, READY)
+	m := &Master{subMap: map[string]*Submission{"running": newSubmission(running, nil)}, archived: map[string]JobDetails{}}
+	m.subMu.Lock()
+	for _, jobId := range []string{"a", "b", "c", "b"} {
+		m.archive(jobId, NewJobDetails(jobId, "owner", jobId, "test", 1, COMPLETE, SUCCESS))
+	}
+	m.subMu.Unlock()
+
+	if want := []string{"b", "c"}; !reflect.DeepEqual(m.archiveList, want) {
+		t.Errorf("archived %v, want %v", m.archiveList, want)
+	}
+
+	tests := []struct {
+		jobId string
+		found bool
+		state string
+	}{
+		{"running", true, RUNNING},
+		{"a", false, ""},
+		{"b", true, COMPLETE},
+		{"c", true, COMPLETE},
+		{"never", false, ""},
+	}
+	for _, test := range tests {
+		dtls, found := m.FindJobDetails(test.jobId)
+		if found != test.found || dtls.State != test.state {
+			t.Errorf("FindJobDetails(%v) = %v, %v, want %v, %v", test.jobId, dtls.State, found, test.state, test.found)
+		}
+	}
+}
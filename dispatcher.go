@@ -0,0 +1,137 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// a submission with the score it had when the dispatcher looked at it
+type rankedSubmission struct {
+	sub          *Submission
+	score        float64
+	waitingSince time.Time
+}
+
+// orders submissions by score, longest waiting first among equals
+type rankedSubmissions []rankedSubmission
+
+func (this rankedSubmissions) Len() int      { return len(this) }
+func (this rankedSubmissions) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+func (this rankedSubmissions) Less(i, j int) bool {
+	if this[i].score != this[j].score {
+		return this[i].score > this[j].score
+	}
+	return this[i].waitingSince.Before(this[j].waitingSince)
+}
+
+// called by node handles with a free slot. takes the next task for nh from the runnable submission with the
+// highest score, returns nil if no submission has anything left to run.  the score is the submission's
+// effective priority plus up to fairShareWeight points for owners that are under their fair share, so fair share
+// only decides between jobs whose priorities are less than fairShareWeight apart.
+// once a higher scoring submission's task has waited reserveAfter seconds for room, a node big enough to run it
+// is kept for it and gets no smaller tasks from lower scoring submissions, so it drains until the task fits.
+func (m *Master) NextJob(nh *NodeHandle) *WorkerJob {
+	if Fenced() {
+		return nil
+	}
+	if draining, _ := nh.Draining(); draining {
+		return nil
+	}
+	if !nh.Healthy() {
+		logger.Debug("NextJob(): [%v] low on memory or disk", nh.NodeId)
+		return nil
+	}
+
+	m.dispatchMu.Lock()
+	defer m.dispatchMu.Unlock()
+
+	now := time.Now()
+	pending := make([]*Submission, 0)
+
+	m.subMu.RLock()
+	for _, s := range m.subMap {
+		if s != nil && s.HasPending() && nh.Satisfies(s.constraints) {
+			pending = append(pending, s)
+		}
+	}
+	m.subMu.RUnlock()
+
+	owners := make([]string, 0, len(pending))
+	for _, s := range pending {
+		owners = append(owners, s.owner)
+	}
+	shares := m.fairShare.Shares(owners)
+
+	ranked := make(rankedSubmissions, 0, len(pending))
+	for _, s := range pending {
+		priority, waitingSince := s.EffectivePriority(now)
+		score := float64(priority) + float64(fairShareWeight)*shares[s.owner].Factor
+		score += float64(preferenceWeight * matchingLabels(nh.Labels, s.preferences))
+		ranked = append(ranked, rankedSubmission{s, score, waitingSince})
+	}
+
+	online := m.NodeIds()
+	sort.Sort(ranked)
+	for _, r := range ranked {
+		if wj := r.sub.NextWorkerJob(nh.NodeId, online, nh.Fits); wj != nil {
+			logger.Debug("NextJob(): [%v, %d, %v]", wj.SubId, wj.JobId, r.score)
+			m.fairShare.Started(r.sub.owner)
+			r.sub.SetUnplaced("")
+			return wj
+		}
+		blocked, since := r.sub.Blocked()
+		if blocked == nil {
+			continue
+		}
+		waited := now.Sub(since)
+		r.sub.SetUnplaced(fmt.Sprintf("task %d needs %d slots and %dMB, no node has had room for %v",
+			blocked.JobId, blocked.Slots(), blocked.Memory, waited/time.Second*time.Second))
+		if reserveAfter > 0 && waited >= time.Duration(reserveAfter)*time.Second && nh.CouldFit(blocked) {
+			logger.Debug("NextJob(): [%v] reserved for [%v, %d]", nh.NodeId, blocked.SubId, blocked.JobId)
+			return nil
+		}
+	}
+	return nil
+}
+
+// called when a worker reports a task finished or errored so the master stops charging its owner for it
+// and the submission can hand out another task under its concurrency limit
+func (m *Master) TaskEnded(wj *WorkerJob) {
+	if s := m.GetSub(wj.SubId); s != nil {
+		m.fairShare.Stopped(s.owner)
+		s.TaskEnded()
+	}
+}
+
+// current shares of every owner with work on the cluster, shown by GET /jobs and GET /nodes
+func (m *Master) OwnerShares() []OwnerShare {
+	owners := make([]string, 0)
+	m.subMu.RLock()
+	for _, s := range m.subMap {
+		if s != nil && s.SniffDetails().IsRunning() {
+			owners = append(owners, s.owner)
+		}
+	}
+	m.subMu.RUnlock()
+	return m.fairShare.List(owners)
+}
@@ -0,0 +1,135 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// stops the node taking new tasks, once its running tasks finish it is told to shut down if shutdown is set
+func (nh *NodeHandle) Drain(shutdown bool) {
+	nh.drainMu.Lock()
+	defer nh.drainMu.Unlock()
+	nh.draining = true
+	nh.drainShutdown = shutdown
+	logger.Printf("Drain(%v): [%v, shutdown=%v]", nh.NodeId, nh.Hostname, shutdown)
+	nh.wake()
+}
+
+// lets the node take new tasks again and calls off its shutdown, if it hasn't been told to shut down yet
+func (nh *NodeHandle) Undrain() {
+	nh.drainMu.Lock()
+	defer nh.drainMu.Unlock()
+	nh.draining = false
+	nh.drainShutdown = false
+	logger.Printf("Undrain(%v): [%v]", nh.NodeId, nh.Hostname)
+	nh.wake()
+}
+
+// whether the node is draining and whether it shuts down once drained
+func (nh *NodeHandle) Draining() (draining bool, shutdown bool) {
+	nh.drainMu.Lock()
+	defer nh.drainMu.Unlock()
+	return nh.draining, nh.drainShutdown
+}
+
+// tells a drained node to shut down once it has no tasks left, returns true if it was told
+func (nh *NodeHandle) ShutdownIfDrained() bool {
+	nh.drainMu.Lock()
+	defer nh.drainMu.Unlock()
+	if !nh.draining || !nh.drainShutdown || nh.shutdownSent {
+		return false
+	}
+	if _, running := nh.Stats(); running > 0 {
+		return false
+	}
+	logger.Printf("ShutdownIfDrained(%v): drained, shutting down [%v]", nh.NodeId, nh.Hostname)
+	nh.shutdownSent = true
+	nh.Con.OutChan <- WorkerMessage{Type: DIE}
+	nh.Master.NodeShutdown(nh)
+	return true
+}
+
+// wakes the node's monitor so it notices a change without waiting for its next poll
+func (nh *NodeHandle) wake() {
+	select {
+	case nh.Update <- 1:
+	default:
+	}
+}
+
+// the connected nodes with the id, or else those running on the host, which can be given as a name or address.
+// the host is resolved before nodeMu is taken so a slow lookup doesn't hold up dispatch.
+func (m *Master) FindNodes(idOrHost string) []*NodeHandle {
+	m.nodeMu.RLock()
+	nh, isin := m.NodeHandles[idOrHost]
+	m.nodeMu.RUnlock()
+	if isin {
+		return []*NodeHandle{nh}
+	}
+
+	addrs := map[string]bool{idOrHost: true}
+	if resolved, err := net.LookupHost(idOrHost); err == nil {
+		for _, addr := range resolved {
+			addrs[addr] = true
+		}
+	}
+
+	m.nodeMu.RLock()
+	defer m.nodeMu.RUnlock()
+	handles := make([]*NodeHandle, 0)
+	for _, nh := range m.NodeHandles {
+		host, _, err := net.SplitHostPort(nh.Address)
+		if err != nil {
+			host = nh.Address
+		}
+		if addrs[host] || addrs[nh.Address] || addrs[nh.Hostname] {
+			handles = append(handles, nh)
+		}
+	}
+	return handles
+}
+
+// POST /nodes/id/drain, POST /nodes/id/drain/shutdown or POST /nodes/id/undrain, id can also be a hostname to
+// act on every node on that host
+func (this MasterNodeController) drain(rw http.ResponseWriter, parts []string) {
+	handles := this.master.FindNodes(parts[0])
+	if len(handles) == 0 {
+		http.Error(rw, "node "+parts[0]+" not found", http.StatusNotFound)
+		return
+	}
+
+	shutdown := len(parts) > 2 && parts[2] == "shutdown"
+	items := make([]WorkerNode, 0, len(handles))
+	for _, nh := range handles {
+		if parts[1] == "drain" {
+			nh.Drain(shutdown)
+		} else {
+			nh.Undrain()
+		}
+		this.master.NodeDrained(nh)
+		items = append(items, NewWorkerNode(nh))
+	}
+	if err := json.NewEncoder(rw).Encode(WorkerNodeList{Items: items, NumberOfItems: len(items)}); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -21,6 +21,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"time"
 )
 
@@ -33,6 +34,18 @@ type ItemsHandle struct {
 type JobDetailsList struct {
 	Items         []JobDetails
 	NumberOfItems int
+	Owners        []OwnerShare
+}
+
+// an owner's configured share of the cluster and recent usage, as seen by the master's fair share scheduler
+type OwnerShare struct {
+	Owner         string
+	Shares        int
+	ShareFraction float64 // fraction of the cluster this owner is entitled to among owners with work
+	Usage         float64 // recent task-seconds, decayed over time
+	UsageFraction float64 // fraction of recent usage belonging to this owner
+	RunningTasks  int
+	Factor        float64 // 1 when idle, 0.5 when using exactly its share, approaching 0 when far over it
 }
 
 type TaskHolder struct {
@@ -41,8 +54,26 @@ type TaskHolder struct {
 }
 
 type Task struct {
-	Count int
-	Args  []string
+	Count  int
+	Args   []string
+	Cpus   int    // worker slots each run of the task occupies, 0 means 1
+	Memory int    // MB of memory each run of the task needs, 0 if unknown
+	Sweep  *Sweep // makes Args a template expanded for every combination of the sweep's values
+
+	Env        map[string]string // added to the worker's environment
+	WorkingDir string            // directory the task runs in, the worker's if empty
+	IdEnv      bool              // pass the task's ids in GOLEM_* environment variables instead of as trailing Args
+
+	Inputs  []TaskInput // files the worker fetches from the master into a directory for the task
+	Outputs []string    // globs, relative to the working directory, of files the worker sends back to the master
+}
+
+// a file put in a task's directory before it runs, the directory is the task's working directory unless it sets one
+type TaskInput struct {
+	Name   string // path in the task directory
+	Blob   string // checksum or name of a blob on the master
+	File   string // or the name of a file sent along with the job
+	Unpack bool   // unpack a .tar, .tar.gz or .tgz into the task directory instead
 }
 
 type JobDetails struct {
@@ -53,10 +84,33 @@ type JobDetails struct {
 	Label string
 	Type  string
 
+	Priority int // higher priority jobs get free worker slots first
+
+	MaxConcurrent int // most tasks of the job running at once, 0 for no limit
+
+	Sweeps []SweepSummary // templates of sweep task lines, Progress.Total counts their expanded tasks
+
+	Retry RetryPolicy
+
+	TaskTimeout int // seconds a task may run before the worker kills it, 0 for no limit
+	JobTimeout  int // seconds the whole job may run before the master stops it, 0 for no limit
+
+	RunningSince int64 // unix time the job started running, its job timeout counts from here
+
+	Prerequisites []string // jobs that must complete before this one runs
+	Condition     string   // AFTER_SUCCESS, AFTER_COMPLETION or AFTER_FAILURE of every prerequisite
+	WaitingOn     []string // prerequisites that have not completed yet
+
+	Constraints   []string // node labels every task requires
+	Preferences   []string // node labels tasks would rather run on
+	Unschedulable bool     // set while no connected node can run some of the job's tasks
+	Unplaced      string   // why the job's next task is still waiting for room on a node, empty once it is placed
+
 	FirstCreated string
 	LastModified string
 
 	Progress TaskProgress
+	Usage    JobUsage
 
 	State  string // job state
 	Status string // job status
@@ -66,27 +120,96 @@ func (this JobDetails) IsRunning() bool {
 	return this.State == RUNNING
 }
 
+// true for jobs that completed with every task finished
+func (this JobDetails) Succeeded() bool {
+	return this.State == COMPLETE && this.Status == SUCCESS && !this.HasFailedTasks()
+}
+
+// true for jobs that failed: they timed out, or ran to the end with some tasks failed for good.  jobs that were
+// stopped or cancelled didn't fail, they never got to.
+func (this JobDetails) Failed() bool {
+	if this.State != COMPLETE {
+		return false
+	}
+	return this.Status == TIMEOUT || (this.Status == SUCCESS && this.HasFailedTasks())
+}
+
+// true if some of the job's tasks failed for good, after using up their retries.  such a job still ends with
+// status SUCCESS once the rest have finished, Progress.Errored says how many failed.
+func (this JobDetails) HasFailedTasks() bool {
+	return this.Progress.Errored > 0
+}
+
 // job state
 const (
 	NEW       = "NEW"       // job received and stored
 	SCHEDULED = "SCHEDULED" // job placed in queue
+	WAITING   = "WAITING"   // job waiting for its prerequisite jobs
 	RUNNING   = "RUNNING"   // job assigned to worker
+	PAUSED    = "PAUSED"    // job handing out no new tasks until it is resumed
 	COMPLETE  = "COMPLETE"  // job is finished
 )
 
 // job status
 const (
-	READY   = "READY"   // NEW, SCHEDULED, RUNNING job
-	SUCCESS = "SUCCESS" // COMPLETE job
-	FAIL    = "FAIL"    // COMPLETE job
-	ERROR   = "ERROR"   // COMPLETE job
-	STOPPED = "STOPPED" // COMPLETE job
+	READY     = "READY"     // NEW, SCHEDULED, WAITING, RUNNING, PAUSED job
+	SUCCESS   = "SUCCESS"   // COMPLETE job
+	ERROR     = "ERROR"     // COMPLETE job
+	STOPPED   = "STOPPED"   // COMPLETE job
+	TIMEOUT   = "TIMEOUT"   // COMPLETE job stopped for running past its job timeout
+	CANCELLED = "CANCELLED" // COMPLETE job that never ran because its prerequisites can't be met
+)
+
+// conditions on prerequisite jobs
+const (
+	AFTER_SUCCESS    = "success"  // run once every prerequisite succeeded
+	AFTER_COMPLETION = "complete" // run once every prerequisite completed, however it ended
+	AFTER_FAILURE    = "failure"  // run once every prerequisite failed, see JobDetails.Failed
 )
 
 type TaskProgress struct {
 	Total    int
 	Finished int
-	Errored  int
+	Errored  int // tasks that failed permanently, after using up their retries
+	Retried  int // failed attempts that were put back on the queue
+	TimedOut int // attempts killed for running longer than the task timeout
+}
+
+// how a submission's failed tasks are retried.  zero values mean use the master's defaults.
+type RetryPolicy struct {
+	MaxAttempts     int   // total attempts per task, 1 means never retry, 0 if unset
+	Backoff         int   // seconds to wait before the first retry, doubled for each further attempt, -1 if unset
+	AvoidFailedNode *bool // retry on a node that has not failed the task when one is connected, nil if unset
+}
+
+// fills in unset fields of the policy from defaults, an explicit 0 backoff or false stays as it is
+func (this RetryPolicy) WithDefaults(defaults RetryPolicy) RetryPolicy {
+	if this.MaxAttempts <= 0 {
+		this.MaxAttempts = defaults.MaxAttempts
+	}
+	if this.Backoff < 0 {
+		this.Backoff = defaults.Backoff
+	}
+	if this.AvoidFailedNode == nil {
+		this.AvoidFailedNode = defaults.AvoidFailedNode
+	}
+	return this
+}
+
+func (this RetryPolicy) AvoidsFailedNode() bool {
+	return this.AvoidFailedNode != nil && *this.AvoidFailedNode
+}
+
+// how long to wait before running a task again after its attempt failed, capped at maxRetryBackoff
+func (this RetryPolicy) BackoffFor(attempt int) time.Duration {
+	backoff := time.Duration(this.Backoff) * time.Second
+	for i := 1; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff
 }
 
 func (this *TaskProgress) isComplete() bool {
@@ -104,7 +227,7 @@ func NewJobDetails(jobId string, owner string, label string, jobtype string, tot
 
 func TotalTasks(tasks []Task) (totalTasks int) {
 	for _, task := range tasks {
-		totalTasks += task.Count
+		totalTasks += task.Size()
 	}
 	return
 }
@@ -112,10 +235,10 @@ func TotalTasks(tasks []Task) (totalTasks int) {
 // workers
 const (
 	HELLO   = iota //sent from worker to master on connect, body is number of processes available
-	CHECKIN        //sent from worker every minute to keep connection alive
+	CHECKIN        //sent from worker every minute to keep connection alive, body is json NodeHealth
 
 	START //sent from master to start job, body is json job
-	KILL  //sent from master to stop jobs, SubId indicates what jobs to stop.
+	KILL  //sent from master to stop jobs, SubId indicates what jobs to stop, a json WorkerJob body limits it to that task
 
 	COUT   //standard out line from worker
 	CERROR //standard err line from worker
@@ -125,12 +248,38 @@ const (
 
 	RESTART //Sent by master to nodes telling them to restart and reconnect themselves.
 	DIE     //tell nodes to shutdown.
+
+	OUTPUT //part of a task's output file from worker, body is json OutputChunk, SubId set
+	KILLED //sent from worker once a task it was told to kill has been terminated, body is json KillReport, SubId set
+	ACK    //sent both ways to acknowledge the messages up to Ack
+
+	WELCOME //sent from master in answer to HELLO, body is json Welcome
+	REFUSED //sent from master to a worker it won't work with for now, ErrMsg says why. the worker backs off and redials
 )
 
 type HelloMsgBody struct {
-	JobCapacity int
-	RunningJobs int
-	UniqueId    string
+	JobCapacity  int
+	RunningJobs  int
+	UniqueId     string
+	RunningTasks []WorkerJob // tasks still running on a worker that is reconnecting
+	Cores        int         // cpu cores on the worker's machine
+	Memory       int         // MB of memory on the worker's machine, 0 if unknown
+	Labels       []string    // labels from the worker's config, e.g. genome=hg38
+	Hostname     string      // the worker's own host name
+	OS           string      // e.g. linux/amd64
+	Kernel       string      // kernel release
+	Version      string      // golem version of the worker
+	Health       *NodeHealth // nil for workers that don't report it
+	Delivery     *Handshake  // where the worker's message numbering stands
+	Protocol     int         // protocol version the worker speaks, 0 for workers that predate versioning
+	Capabilities []string    // what the worker can do, e.g. staging
+}
+
+// how a worker is doing, sent in HELLO and as the body of every CHECKIN.  -1 for what the worker can't tell
+type NodeHealth struct {
+	LoadAverage float64 // over the last minute
+	FreeMemory  int     // MB
+	FreeDisk    int     // MB free where the worker stages task inputs
 }
 
 func NewHelloMsgBody(data string) (*HelloMsgBody, error) {
@@ -139,26 +288,77 @@ func NewHelloMsgBody(data string) (*HelloMsgBody, error) {
 	return rv, err
 }
 
+// what the master knows about a task that has been sent to a node, shown by GET /jobs/id/tasks
+type TaskRecord struct {
+	SubId   string
+	TaskId  int
+	LineId  int
+	Args    []string
+	State   string // TASK_RUNNING, TASK_QUEUED, TASK_FINISHED or TASK_ERRORED
+	NodeId  string // the node that ran the latest attempt
+	Host    string
+	Attempt int
+	Started string
+	Ended   string
+	Error   string // why the latest attempt failed
+	Result  *TaskResult
+	Killed  string // the signal that terminated the task after a KILL or timeout, SIGTERM or SIGKILL
+}
+
+type TaskRecordList struct {
+	Items         []TaskRecord
+	NumberOfItems int
+}
+
+// task state
+const (
+	TASK_RUNNING  = "RUNNING"  // task sent to a node
+	TASK_QUEUED   = "QUEUED"   // task waiting to run again after an error or losing its node
+	TASK_FINISHED = "FINISHED" // task ran successfully
+	TASK_ERRORED  = "ERRORED"  // task failed for good
+)
+
 type WorkerNodeList struct {
 	Items         []WorkerNode
 	NumberOfItems int
+	Owners        []OwnerShare
 }
 
 type WorkerNode struct {
-	NodeId      string
-	Uri         string
-	Hostname    string
-	MaxJobs     int
-	RunningJobs int
-	Running     bool
+	NodeId       string
+	Uri          string
+	Hostname     string
+	MaxJobs      int // worker slots
+	RunningJobs  int // worker slots in use
+	Running      bool
+	Cores        int
+	Memory       int // MB
+	MemoryInUse  int // MB requested by the tasks running on the node
+	Labels       []string
+	Draining     bool   // takes no new tasks
+	Shutdown     bool   // shuts down once drained
+	LastSeen     string // when the node last sent a message
+	Address      string // the worker's end of the connection
+	OS           string
+	Kernel       string
+	Version      string
+	Health       *NodeHealth // load average, free memory and free disk from the node's latest checkin
+	Healthy      bool        // false if the node is too low on memory or disk to be given new tasks
+	Protocol     int         // protocol version used with the node
+	Capabilities []string    // what the node and master agreed to use
 }
 
 func NewWorkerNode(nh *NodeHandle) WorkerNode {
 	logger.Debug("NewWorkerNode()")
 	maxJobs, running := nh.Stats()
+	draining, shutdown := nh.Draining()
 	logger.Debug("creating new worker: %d,%d", maxJobs, running)
 	return WorkerNode{NodeId: nh.NodeId, Uri: nh.Uri, Hostname: nh.Hostname,
-		MaxJobs: maxJobs, RunningJobs: running, Running: (running > 0)}
+		MaxJobs: maxJobs, RunningJobs: running, Running: (running > 0),
+		Cores: nh.Cores, Memory: nh.Memory, MemoryInUse: nh.MemoryUsed(), Labels: nh.Labels,
+		Draining: draining, Shutdown: shutdown, LastSeen: nh.LastSeen().String(),
+		Address: nh.Address, OS: nh.OS, Kernel: nh.Kernel, Version: nh.Version, Health: nh.Health(), Healthy: nh.Healthy(),
+		Protocol: nh.Protocol, Capabilities: nh.Capabilities}
 }
 
 type WorkerMessage struct {
@@ -166,6 +366,8 @@ type WorkerMessage struct {
 	SubId  string
 	Body   string
 	ErrMsg string
+	Seq    int64 // numbers the messages sent each way, 0 for HELLO and ACK
+	Ack    int64 // seq of the last message the sender received
 }
 
 func (wm *WorkerMessage) BodyFromInterface(Body interface{}) error {
@@ -181,10 +383,77 @@ func (wm *WorkerMessage) BodyFromInterface(Body interface{}) error {
 
 //Internal Job Representation used primarily as the body of job related messages
 type WorkerJob struct {
-	SubId  string
-	LineId int
-	JobId  int
-	Args   []string
+	SubId    string
+	LineId   int
+	JobId    int
+	Args     []string
+	Attempt  int      // 1 for the first run of a task, incremented on each retry
+	FailedOn []string // NodeIds of workers where earlier attempts errored
+	Timeout  int      // seconds the worker lets the task run before killing it, 0 for no limit
+	TimedOut bool     // set by the worker when it killed the task for running past Timeout
+	Cpus     int      // worker slots the task occupies, 0 means 1
+	Memory   int      // MB of memory the task needs, 0 if unknown
+	Error    string   // the worker's error message when the task errored
+	Result   *TaskResult
+
+	Env        map[string]string
+	WorkingDir string
+	IdEnv      bool
+	Inputs     []TaskInput
+	Outputs    []string
+}
+
+// how a task's process ended and what it used, reported by the worker
+type TaskResult struct {
+	ExitCode int    // -1 if the process didn't exit normally
+	Signal   string // the signal that killed the process, if one did
+	UserCpu  float64
+	SysCpu   float64
+	MaxRssKB int64
+	WallTime float64 // seconds from start to exit
+}
+
+// resources used by a job's tasks, summed over every attempt
+type JobUsage struct {
+	Tasks    int // task attempts that reported a result
+	UserCpu  float64
+	SysCpu   float64
+	WallTime float64
+	MaxRssKB int64 // the largest of any task
+	NonZero  int   // attempts that exited with a non-zero code
+	Signaled int   // attempts killed by a signal
+}
+
+// adds a task attempt's result to the job's usage
+func (this *JobUsage) Add(result *TaskResult) {
+	if result == nil {
+		return
+	}
+	this.Tasks++
+	this.UserCpu += result.UserCpu
+	this.SysCpu += result.SysCpu
+	this.WallTime += result.WallTime
+	if result.MaxRssKB > this.MaxRssKB {
+		this.MaxRssKB = result.MaxRssKB
+	}
+	if result.Signal != "" {
+		this.Signaled++
+	} else if result.ExitCode != 0 {
+		this.NonZero++
+	}
+}
+
+// the number of worker slots the task occupies
+func (this *WorkerJob) Slots() int {
+	if this.Cpus < 1 {
+		return 1
+	}
+	return this.Cpus
+}
+
+// identifies a task across retries and reconnects
+func (this *WorkerJob) Key() string {
+	return fmt.Sprintf("%v/%v", this.SubId, this.JobId)
 }
 
 type SubmitedWorkerJob struct {
@@ -0,0 +1,84 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyWithDefaults(t *testing.T) {
+	yes, no := true, false
+	defaults := RetryPolicy{MaxAttempts: 3, Backoff: 30, AvoidFailedNode: &yes}
+	tests := []struct {
+		policy RetryPolicy
+		want   RetryPolicy
+	}{
+		{RetryPolicy{Backoff: -1}, RetryPolicy{MaxAttempts: 3, Backoff: 30, AvoidFailedNode: &yes}},
+		{RetryPolicy{MaxAttempts: 1, Backoff: 0, AvoidFailedNode: &no}, RetryPolicy{MaxAttempts: 1, Backoff: 0, AvoidFailedNode: &no}},
+		{RetryPolicy{MaxAttempts: 5, Backoff: 10}, RetryPolicy{MaxAttempts: 5, Backoff: 10, AvoidFailedNode: &yes}},
+		{RetryPolicy{MaxAttempts: -2, Backoff: -1, AvoidFailedNode: &no}, RetryPolicy{MaxAttempts: 3, Backoff: 30, AvoidFailedNode: &no}},
+	}
+	for _, test := range tests {
+		got := test.policy.WithDefaults(defaults)
+		if got.MaxAttempts != test.want.MaxAttempts || got.Backoff != test.want.Backoff ||
+			got.AvoidsFailedNode() != test.want.AvoidsFailedNode() {
+			t.Errorf("%+v WithDefaults() = %+v, want %+v", test.policy, got, test.want)
+		}
+	}
+}
+
+func TestRetryPolicyAvoidsFailedNode(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		avoid *bool
+		want  bool
+	}{
+		{nil, false},
+		{&no, false},
+		{&yes, true},
+	}
+	for _, test := range tests {
+		if got := (RetryPolicy{AvoidFailedNode: test.avoid}).AvoidsFailedNode(); got != test.want {
+			t.Errorf("AvoidsFailedNode() with %v = %v, want %v", test.avoid, got, test.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffFor(t *testing.T) {
+	tests := []struct {
+		backoff int
+		attempt int
+		want    time.Duration
+	}{
+		{30, 0, 30 * time.Second},
+		{30, 1, 30 * time.Second},
+		{30, 2, time.Minute},
+		{30, 4, 4 * time.Minute},
+		{30, 20, maxRetryBackoff},
+		{0, 5, 0},
+		{7200, 1, maxRetryBackoff},
+	}
+	for _, test := range tests {
+		if got := (RetryPolicy{Backoff: test.backoff}).BackoffFor(test.attempt); got != test.want {
+			t.Errorf("backoff %d BackoffFor(%d) = %v, want %v", test.backoff, test.attempt, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// keeps track of how many task-seconds each job owner has used recently.  usage decays with a half life
+// of fairShareHalfLife seconds so only recent work counts against an owner.
+type FairShare struct {
+	mu      sync.Mutex
+	usage   map[string]float64 // decayed task-seconds by owner
+	running map[string]int     // tasks currently assigned to workers by owner
+	accrued time.Time          // last time usage was brought up to date
+}
+
+func NewFairShare() *FairShare {
+	return &FairShare{usage: map[string]float64{}, running: map[string]int{}, accrued: time.Now()}
+}
+
+// records that a task owned by owner was handed to a worker
+func (fs *FairShare) Started(owner string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.accrue(time.Now())
+	fs.running[owner]++
+}
+
+// records that a task owned by owner is no longer running
+func (fs *FairShare) Stopped(owner string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.accrue(time.Now())
+	if fs.running[owner] > 0 {
+		fs.running[owner]--
+	}
+}
+
+// decays existing usage and charges running tasks for the time since the last call, must be called with mu held
+func (fs *FairShare) accrue(now time.Time) {
+	elapsed := now.Sub(fs.accrued).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	decay := 1.0
+	if fairShareHalfLife > 0 {
+		decay = math.Pow(0.5, elapsed/float64(fairShareHalfLife))
+	}
+	for owner, used := range fs.usage {
+		fs.usage[owner] = used * decay
+	}
+	for owner, running := range fs.running {
+		fs.usage[owner] += float64(running) * elapsed
+	}
+	fs.accrued = now
+}
+
+// computes the current share and usage of the given owners plus any owner that still has tasks running.
+// shares are normalized over that set of owners, so an idle owner's slots are split among the others.
+func (fs *FairShare) Shares(owners []string) map[string]OwnerShare {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.accrue(time.Now())
+
+	active := map[string]bool{}
+	for _, owner := range owners {
+		active[owner] = true
+	}
+	for owner, running := range fs.running {
+		if running > 0 {
+			active[owner] = true
+		}
+	}
+
+	totalShares := 0
+	totalUsage := 0.0
+	for owner := range active {
+		totalShares += OwnerShares(owner)
+		totalUsage += fs.usage[owner]
+	}
+
+	shares := map[string]OwnerShare{}
+	for owner := range active {
+		share := OwnerShare{Owner: owner, Shares: OwnerShares(owner), Usage: fs.usage[owner], RunningTasks: fs.running[owner]}
+		if totalShares > 0 {
+			share.ShareFraction = float64(share.Shares) / float64(totalShares)
+		}
+		if totalUsage > 0 {
+			share.UsageFraction = share.Usage / totalUsage
+		}
+		// owners under their share get a factor near 1, owners far over it approach 0
+		if share.ShareFraction > 0 {
+			share.Factor = math.Pow(2, -share.UsageFraction/share.ShareFraction)
+		}
+		shares[owner] = share
+	}
+	return shares
+}
+
+// like Shares but sorted by owner name, used in job and node listings
+func (fs *FairShare) List(owners []string) []OwnerShare {
+	shares := fs.Shares(owners)
+	names := make([]string, 0, len(shares))
+	for owner := range shares {
+		names = append(names, owner)
+	}
+	sort.Strings(names)
+
+	items := make([]OwnerShare, 0, len(names))
+	for _, owner := range names {
+		items = append(items, shares[owner])
+	}
+	return items
+}
@@ -0,0 +1,139 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// close enough for usage that decayed over the moment a test takes
+func nearly(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-3
+}
+
+func TestFairShareShares(t *testing.T) {
+	defer func(shares map[string]int, defaultShares int) {
+		ownerShares, fairShareDefault = shares, defaultShares
+	}(ownerShares, fairShareDefault)
+	fairShareDefault = 1
+
+	tests := []struct {
+		name    string
+		shares  map[string]int
+		usage   map[string]float64
+		running map[string]int
+		owners  []string
+		want    map[string]float64 // factor by owner
+	}{
+		{"idle", map[string]int{}, map[string]float64{}, map[string]int{}, []string{"a", "b"},
+			map[string]float64{"a": 1, "b": 1}},
+		{"a over its share", map[string]int{}, map[string]float64{"a": 300, "b": 100}, map[string]int{}, []string{"a", "b"},
+			map[string]float64{"a": math.Pow(2, -1.5), "b": math.Pow(2, -0.5)}},
+		{"weighted shares", map[string]int{"a": 3}, map[string]float64{"a": 300, "b": 100}, map[string]int{}, []string{"a", "b"},
+			map[string]float64{"a": 0.5, "b": 0.5}},
+		{"running owner counts", map[string]int{}, map[string]float64{"b": 100}, map[string]int{"b": 1}, []string{"a"},
+			map[string]float64{"a": 1, "b": 0.25}},
+		{"idle owner left out", map[string]int{}, map[string]float64{"b": 100}, map[string]int{}, []string{"a"},
+			map[string]float64{"a": 1}},
+		{"no shares", map[string]int{"a": 0}, map[string]float64{"a": 100}, map[string]int{}, []string{"a"},
+			map[string]float64{"a": 0}},
+	}
+	for _, test := range tests {
+		ownerShares = test.shares
+		fs := NewFairShare()
+		fs.usage, fs.running = test.usage, test.running
+
+		got := fs.Shares(test.owners)
+		if len(got) != len(test.want) {
+			t.Errorf("%v: Shares(%v) has owners %v, want %v", test.name, test.owners, got, test.want)
+			continue
+		}
+		for owner, factor := range test.want {
+			if !nearly(got[owner].Factor, factor) {
+				t.Errorf("%v: Shares(%v)[%v].Factor = %v, want %v", test.name, test.owners, owner, got[owner].Factor, factor)
+			}
+		}
+	}
+}
+
+func TestFairShareAccrue(t *testing.T) {
+	defer func(halfLife int) { fairShareHalfLife = halfLife }(fairShareHalfLife)
+	fairShareHalfLife = 3600
+
+	tests := []struct {
+		usage   float64
+		running int
+		elapsed time.Duration
+		want    float64
+	}{
+		{100, 0, time.Hour, 50},
+		{100, 0, 2 * time.Hour, 25},
+		{0, 2, time.Minute, 120},
+		{100, 1, time.Hour, 50 + 3600},
+		{100, 1, -time.Minute, 100},
+	}
+	for _, test := range tests {
+		fs := NewFairShare()
+		fs.usage["a"] = test.usage
+		fs.running["a"] = test.running
+		fs.accrue(fs.accrued.Add(test.elapsed))
+		if !nearly(fs.usage["a"], test.want) {
+			t.Errorf("usage %v with %d running after %v = %v, want %v", test.usage, test.running, test.elapsed, fs.usage["a"], test.want)
+		}
+	}
+}
+
+func TestFairShareStartedStopped(t *testing.T) {
+	fs := NewFairShare()
+	steps := []struct {
+		started bool
+		owner   string
+		want    map[string]int
+	}{
+		{true, "a", map[string]int{"a": 1}},
+		{true, "a", map[string]int{"a": 2}},
+		{true, "b", map[string]int{"a": 2, "b": 1}},
+		{false, "a", map[string]int{"a": 1, "b": 1}},
+		{false, "b", map[string]int{"a": 1, "b": 0}},
+		{false, "b", map[string]int{"a": 1, "b": 0}},
+	}
+	for _, step := range steps {
+		if step.started {
+			fs.Started(step.owner)
+		} else {
+			fs.Stopped(step.owner)
+		}
+		if !reflect.DeepEqual(fs.running, step.want) {
+			t.Errorf("started=%v %v: running %v, want %v", step.started, step.owner, fs.running, step.want)
+		}
+	}
+
+	owners := make([]string, 0)
+	for _, share := range fs.List(nil) {
+		owners = append(owners, share.Owner)
+	}
+	if !sort.StringsAreSorted(owners) || !reflect.DeepEqual(owners, []string{"a"}) {
+		t.Errorf("List() = %v, want [a]", owners)
+	}
+}
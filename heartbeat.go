@@ -0,0 +1,97 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"time"
+)
+
+// records that a message arrived from the node
+func (nh *NodeHandle) Seen() {
+	nh.seenMu.Lock()
+	defer nh.seenMu.Unlock()
+	nh.lastSeen = time.Now()
+}
+
+// when the node was last heard from
+func (nh *NodeHandle) LastSeen() time.Time {
+	nh.seenMu.Lock()
+	defer nh.seenMu.Unlock()
+	return nh.lastSeen
+}
+
+// true while the node is connected and has been heard from within the last checkin interval.  a worker that
+// restarted leaves a half open connection behind that goes quiet, a second worker with the same id is still
+// checking in on its own.
+func (nh *NodeHandle) InUse() bool {
+	return nh.Connected() && time.Since(nh.LastSeen()) < time.Duration(checkinInterval)*time.Second
+}
+
+// records the health a node reported
+func (nh *NodeHandle) SetHealth(health *NodeHealth) {
+	nh.seenMu.Lock()
+	defer nh.seenMu.Unlock()
+	nh.health = health
+}
+
+// the health the node last reported, nil if it doesn't report it
+func (nh *NodeHandle) Health() *NodeHealth {
+	nh.seenMu.Lock()
+	defer nh.seenMu.Unlock()
+	return nh.health
+}
+
+// false if the node last reported less free memory or scratch disk than minfreememory or minfreedisk.  nodes
+// that don't report their health, or can't tell, are given the benefit of the doubt.
+func (nh *NodeHandle) Healthy() bool {
+	health := nh.Health()
+	if health == nil {
+		return true
+	}
+	if minFreeMemory > 0 && health.FreeMemory >= 0 && health.FreeMemory < minFreeMemory {
+		return false
+	}
+	if minFreeDisk > 0 && health.FreeDisk >= 0 && health.FreeDisk < minFreeDisk {
+		return false
+	}
+	return true
+}
+
+// closes the connection of a node that has missed missedCheckins checkins in a row.  a frozen host or a network
+// partition doesn't always end the connection, this ends it so the node is removed and its tasks are held for
+// reconnectGrace seconds and then requeued, the same as for a node that disconnected.
+func (nh *NodeHandle) MonitorHeartbeat() {
+	timeout := time.Duration(missedCheckins*checkinInterval) * time.Second
+	for {
+		select {
+		case <-nh.dead:
+			return
+		case <-time.After(time.Duration(checkinInterval) * time.Second):
+		}
+
+		if silent := time.Since(nh.LastSeen()); silent > timeout {
+			logger.Printf("MonitorHeartbeat(%v): not heard from in %v, missed %d checkins, closing [%v]",
+				nh.NodeId, silent, missedCheckins, nh.Hostname)
+			nh.Master.nodeEvent(nh.NodeId, "missed checkins", silent.String(), nil)
+			nh.Con.socket().Close()
+			return
+		}
+	}
+}
@@ -6,7 +6,9 @@ JobsGrid = Ext.extend(ItemsGrid, {
 
         this.groupField = "State";
         this.toolbarButtons = [
-            { text: 'Stop Selected', iconCls:'stop', disabled: true, ref: "../stopButton" }
+            { text: 'Stop Selected', iconCls:'stop', disabled: true, ref: "../stopButton" },
+            { text: 'Pause Selected', disabled: true, ref: "../pauseButton" },
+            { text: 'Resume Selected', disabled: true, ref: "../resumeButton" }
         ];
         this.gridColumns = [
             { header: "Job ID", width: 25, dataIndex: 'JobId', sortable: false, hidden:true },
@@ -18,6 +20,7 @@ JobsGrid = Ext.extend(ItemsGrid, {
             { header: "Total", width: 10, sortable: true, dataIndex: 'Total' },
             { header: "Finished", width: 10, sortable: true, dataIndex: 'Finished' },
             { header: "Errored", width: 10, sortable: true, dataIndex: 'Errored' },
+            { header: "Retried", width: 10, sortable: true, dataIndex: 'Retried', hidden: true },
             { header: "State", width: 10, sortable: true, dataIndex: 'State', hidden: true },
             { header: "Status", width: 10, sortable: true, dataIndex: 'Status', hidden: false }
         ];
@@ -31,6 +34,7 @@ JobsGrid = Ext.extend(ItemsGrid, {
             {name: 'Total', type: 'int'},
             {name: 'Finished', type: 'int'},
             {name: 'Errored', type: 'int'},
+            {name: 'Retried', type: 'int'},
             {name: 'State' },
             {name: 'Status' }
         ];
@@ -43,20 +47,38 @@ JobsGrid = Ext.extend(ItemsGrid, {
 
         this.selectionModel.on("selectionchange", this.enableButtonsOnSelectionChange, this);
         this.grid.stopButton.on("click", this.onStop, this);
+        this.grid.pauseButton.on("click", this.onPause, this);
+        this.grid.resumeButton.on("click", this.onResume, this);
     },
 
     enableButtonsOnSelectionChange: function(sm) {
         if (sm.getCount()) {
             this.grid.stopButton.enable();
+            this.grid.pauseButton.enable();
+            this.grid.resumeButton.enable();
         } else {
             this.grid.stopButton.disable();
+            this.grid.pauseButton.disable();
+            this.grid.resumeButton.disable();
         }
     },
 
     onStop: function() {
+        this.postToSelected("/stop");
+    },
+
+    onPause: function() {
+        this.postToSelected("/pause");
+    },
+
+    onResume: function() {
+        this.postToSelected("/resume");
+    },
+
+    postToSelected: function(action) {
         this.selectionModel.each(function(row) {
             Ext.Ajax.request({
-                url: row.data.Uri + "/stop",
+                url: row.data.Uri + action,
                 method: "post",
                 failure: this.showMessage,
                 scope: this
@@ -76,6 +98,7 @@ JobsGrid = Ext.extend(ItemsGrid, {
             job.Progress.Total,
             job.Progress.Finished,
             job.Progress.Errored,
+            job.Progress.Retried,
             job.State,
             job.Status
         ];
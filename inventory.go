@@ -0,0 +1,108 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// reads a value in kB from /proc/meminfo and returns it in MB, 0 if it can't be read (e.g. not on linux)
+func MemInfoMB(key string) int {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		logger.Warn(err)
+		return 0
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == key+":" {
+			kb, err := strconv.Atoi(fields[1])
+			if err != nil {
+				logger.Warn(err)
+				return 0
+			}
+			return kb / 1024
+		}
+		if err != nil {
+			return 0
+		}
+	}
+}
+
+// the worker's load average, free memory and free scratch disk right now, -1 for what can't be read
+func CurrentHealth() *NodeHealth {
+	health := &NodeHealth{LoadAverage: -1, FreeMemory: -1, FreeDisk: -1}
+	if data, err := ioutil.ReadFile("/proc/loadavg"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 0 {
+			if load, err := strconv.ParseFloat(fields[0], 64); err == nil {
+				health.LoadAverage = load
+			}
+		}
+	}
+	if free := MemInfoMB("MemAvailable"); free > 0 {
+		health.FreeMemory = free
+	}
+	if free, err := FreeDiskMB(stageDir); err == nil {
+		health.FreeDisk = free
+	} else {
+		logger.Warn(err)
+	}
+	return health
+}
+
+// MB free to unprivileged users on the file system holding dir, or its nearest existing parent
+func FreeDiskMB(dir string) (int, error) {
+	for {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(dir, &stat)
+		if err == nil {
+			return int(uint64(stat.Bavail) * uint64(stat.Bsize) / (1024 * 1024)), nil
+		}
+		parent := filepath.Dir(dir)
+		if !os.IsNotExist(err) || parent == dir {
+			return 0, err
+		}
+		dir = parent
+	}
+}
+
+// the worker's host name, operating system and kernel release
+func HostInventory() (hostname string, system string, kernel string) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Warn(err)
+	}
+	system = runtime.GOOS + "/" + runtime.GOARCH
+	if data, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		kernel = strings.TrimSpace(string(data))
+	}
+	return
+}
@@ -22,38 +22,81 @@ package main
 import (
 	"fmt"
 	"syscall"
+	"time"
 )
 
 // links a SubId and JobId with a pid that can be used to kill it
 type Killable struct {
-	Pid   int
+	Pid   int // also the id of the task's process group, each task is started in a group of its own
 	SubId string
 	JobId int
 }
 
-// kills via the stored process id
-func (k *Killable) Kill() {
-	logger.Printf("kill process id: %v", k.Pid)
-	errno := syscall.Kill(k.Pid, syscall.SIGCHLD)
-	logger.Printf("kill results: %v: %v", k.Pid, errno)
+// what a worker did to a task it was told to kill, the body of a KILLED message
+type KillReport struct {
+	SubId  string
+	TaskId int
+	Pid    int
+	Signal string // SIGTERM if the task's process group exited within the grace period, SIGKILL if it had to be forced
+}
+
+// kills the task's whole process group, so children of shell wrappers go with it.  the group gets SIGTERM and
+// killGrace seconds to exit, then SIGKILL.  returns the last signal sent, "" if the group was already gone.
+func (k *Killable) Kill() string {
+	logger.Printf("kill process group: %v", k.Pid)
+	if err := syscall.Kill(-k.Pid, syscall.SIGTERM); err != nil {
+		logger.Printf("kill results: %v: %v", k.Pid, err)
+		return ""
+	}
+
+	deadline := time.Now().Add(time.Duration(killGrace) * time.Second)
+	for time.Now().Before(deadline) {
+		// signal 0 only checks whether anything is left in the group
+		if err := syscall.Kill(-k.Pid, 0); err == syscall.ESRCH {
+			logger.Printf("kill results: %v: exited after SIGTERM", k.Pid)
+			return "SIGTERM"
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	errno := syscall.Kill(-k.Pid, syscall.SIGKILL)
+	logger.Printf("kill results: %v: SIGKILL after %d secs: %v", k.Pid, killGrace, errno)
+	if errno == syscall.ESRCH {
+		return "SIGTERM"
+	}
+	return "SIGKILL"
 }
 
 //A job killer is created to monitor and kill jobs
 type JobKiller struct {
-	Killchan     chan string    //used to send in the SubId of jobs to kill
-	Donechan     chan *Killable //used to indicate that a job is done and should no longer be killable
-	Registerchan chan *Killable //used to register a job as a killable
+	Killchan     chan string     //used to send in the SubId of jobs to kill
+	KillTaskchan chan *WorkerJob //used to send in a single task to kill
+	Donechan     chan *Killable  //used to indicate that a job is done and should no longer be killable
+	Registerchan chan *Killable  //used to register a job as a killable
 
 	killables map[string]*Killable //internal structure to keep track of killables by subid+jobId (as strings)
+	outChan   chan WorkerMessage   //where KILLED confirmations are sent
 }
 
-//creates a Job Killer and starts its routine KillJobs
-func NewJobKiller() (jk *JobKiller) {
-	jk = &JobKiller{Killchan: make(chan string, 3), Donechan: make(chan *Killable, 3), Registerchan: make(chan *Killable, 3), killables: map[string]*Killable{}}
+//creates a Job Killer and starts its routine KillJobs, KILLED confirmations are sent to outChan
+func NewJobKiller(outChan chan WorkerMessage) (jk *JobKiller) {
+	jk = &JobKiller{Killchan: make(chan string, 3), KillTaskchan: make(chan *WorkerJob, 3), Donechan: make(chan *Killable, 3), Registerchan: make(chan *Killable, 3), killables: map[string]*Killable{},
+		outChan: outChan}
 	go jk.KillJobs()
 	return
 }
 
+// kills a task and confirms to the master that it was terminated and how
+func (jk *JobKiller) Terminate(kb *Killable) {
+	signal := kb.Kill()
+	if signal == "" {
+		return
+	}
+	msg := WorkerMessage{Type: KILLED, SubId: kb.SubId}
+	msg.BodyFromInterface(KillReport{SubId: kb.SubId, TaskId: kb.JobId, Pid: kb.Pid, Signal: signal})
+	jk.outChan <- msg
+}
+
 // should be run as a go routine, monitors job killers channel.  maintains the internal map of killables and locates jobs that need to be killed.
 func (jk *JobKiller) KillJobs() {
 	for {
@@ -62,10 +105,16 @@ func (jk *JobKiller) KillJobs() {
 			logger.Debug("killing: %v", SubId)
 			for _, kb := range jk.killables {
 				if kb.SubId == SubId {
-					kb.Kill()
+					// each task gets its grace period at the same time
+					go jk.Terminate(kb)
 				}
 			}
 			logger.Debug("done killing: %v", SubId)
+		case job := <-jk.KillTaskchan:
+			logger.Debug("killing task: %v", job.Key())
+			if kb, isin := jk.killables[fmt.Sprintf("%v%v", job.SubId, job.JobId)]; isin {
+				go jk.Terminate(kb)
+			}
 		case kb := <-jk.Registerchan:
 			logger.Debug("registering: %v", kb)
 			jk.killables[fmt.Sprintf("%v%v", kb.SubId, kb.JobId)] = kb
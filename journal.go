@@ -0,0 +1,532 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kinds of journal records
+const (
+	JOURNAL_SUBMIT  = "SUBMIT"  // a new job with its tasks
+	JOURNAL_DETAILS = "DETAILS" // the job's details after its state, priority or limits changed
+	JOURNAL_ASSIGN  = "ASSIGN"  // a task sent to a node
+	JOURNAL_FINISH  = "FINISH"  // a task that finished
+	JOURNAL_RETRY   = "RETRY"   // a task that errored and was queued to run again
+	JOURNAL_ERROR   = "ERROR"   // a task that errored for good
+	JOURNAL_LOST    = "LOST"    // a task queued to run again after its node was lost
+	JOURNAL_ARCHIVE = "ARCHIVE" // the job was archived, only its final details are kept
+	JOURNAL_NODE    = "NODE"    // a node's registry record after it connected, disconnected, or was resized or drained
+)
+
+// one line of the journal
+type JournalRecord struct {
+	Type    string
+	JobId   string
+	Details *JobDetails `json:",omitempty"`
+	Tasks   []Task      `json:",omitempty"`
+	Task    *WorkerJob  `json:",omitempty"`
+	NodeId  string      `json:",omitempty"`
+	Host    string      `json:",omitempty"`
+	Node    *NodeRecord `json:",omitempty"`
+	Time    string      `json:",omitempty"` // when the record was written
+}
+
+// append only file of JSON records the master replays on startup to rebuild its submissions.  records are synced
+// to disk in batches, at most journalSyncDelay after they are written.  it is compacted in the background once it
+// grows past journalCompactSize MB and has doubled since it was last compacted.
+type Journal struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	encoder    *json.Encoder
+	size       int64    // bytes in the file
+	compacted  int64    // bytes in the file after it was last compacted
+	compacting bool     // a compaction is running
+	unsynced   chan int // holds a value while records have been written that aren't synced yet
+}
+
+// longest a record waits to be synced, the records written meanwhile share one sync
+const journalSyncDelay = 50 * time.Millisecond
+
+// the master's journal, nil when journaling is turned off
+var journal *Journal
+
+// opens the journal at path for appending
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{path: path, file: file, unsynced: make(chan int, 1)}
+	if info, err := file.Stat(); err == nil {
+		j.size = info.Size()
+		j.compacted = j.size
+	}
+	j.encoder = json.NewEncoder(&countingWriter{file, &j.size})
+	go j.SyncRecords()
+	return j, nil
+}
+
+// counts the bytes written through it
+type countingWriter struct {
+	w     io.Writer
+	count *int64
+}
+
+func (this *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = this.w.Write(p)
+	*this.count += int64(n)
+	return
+}
+
+// appends a record, which SyncRecords syncs to disk shortly after.  does nothing when journaling is off.  callers
+// may hold their own locks, it never waits on the disk or on a compaction.
+func (j *Journal) Record(rec JournalRecord) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	rec.Time = time.Now().String()
+	if err := j.encoder.Encode(rec); err != nil {
+		logger.Warn(err)
+		return
+	}
+	select {
+	case j.unsynced <- 1:
+	default:
+	}
+	if !j.compacting && journalCompactSize > 0 && j.size > int64(journalCompactSize)<<20 && j.size > 2*j.compacted {
+		j.compacting = true
+		go j.compact()
+	}
+}
+
+// syncs the journal to disk journalSyncDelay after a record is written, usually started in OpenJournal
+func (j *Journal) SyncRecords() {
+	for {
+		<-j.unsynced
+		<-time.After(journalSyncDelay)
+		j.mu.Lock()
+		if err := j.file.Sync(); err != nil {
+			logger.Warn(err)
+		}
+		j.mu.Unlock()
+	}
+}
+
+// rewrites the journal the same way it is rewritten on startup and swaps it in.  the records up to where the
+// journal was when it started are read and rewritten without holding j.mu, only the records appended since are
+// copied over with it held.
+func (j *Journal) compact() {
+	start := time.Now()
+	j.mu.Lock()
+	before := j.size
+	if err := j.file.Sync(); err != nil {
+		logger.Warn(err)
+	}
+	j.mu.Unlock()
+
+	file, err := j.rewriteUpTo(before)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.compacting = false
+	if err == nil {
+		err = j.copyTail(file, before)
+	}
+	if err == nil {
+		err = os.Rename(j.path+".tmp", j.path)
+	}
+	if err != nil {
+		logger.Warn(err)
+		if file != nil {
+			file.Close()
+		}
+		j.compacted = j.size
+		return
+	}
+
+	j.file.Close()
+	j.file = file
+	j.size = 0
+	if info, err := file.Stat(); err == nil {
+		j.size = info.Size()
+	}
+	j.compacted = j.size
+	j.encoder = json.NewEncoder(&countingWriter{file, &j.size})
+	logger.Printf("compacted journal [%v] from %d to %d bytes in %v", j.path, before, j.size, time.Since(start))
+}
+
+// replays the first size bytes of the journal and writes them compacted to the journal's .tmp file, left open
+func (j *Journal) rewriteUpTo(size int64) (*os.File, error) {
+	old, err := os.Open(j.path)
+	if err != nil {
+		return nil, err
+	}
+	order, jobs, nodes := replayJournal(io.NewSectionReader(old, 0, size))
+	old.Close()
+	return writeCompacted(j.path, order, jobs, nodes)
+}
+
+// appends what was written to the journal after offset to file and syncs it, must be called with j.mu held
+func (j *Journal) copyTail(file *os.File, offset int64) error {
+	old, err := os.Open(j.path)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	if _, err = io.Copy(file, io.NewSectionReader(old, offset, j.size-offset)); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// records a job's details after they changed
+func (j *Journal) Details(dtls JobDetails) {
+	j.Record(JournalRecord{Type: JOURNAL_DETAILS, JobId: dtls.JobId, Details: &dtls})
+}
+
+// a job as rebuilt from the journal
+type journaledJob struct {
+	records     []JournalRecord
+	details     JobDetails
+	tasks       []Task
+	ended       map[int]bool          // tasks that finished or failed for good
+	assigned    map[int]JournalRecord // tasks on a node that hasn't reported back on them
+	requeued    map[int]*WorkerJob    // tasks waiting to run again
+	lost        map[int]bool          // requeued tasks that were lost with their node rather than failed
+	taskRecords map[int]*TaskRecord   // tasks that have been sent to a node, as GET /jobs/id/tasks shows them
+	archived    bool
+}
+
+func (this *journaledJob) apply(rec JournalRecord) {
+	if rec.Type != JOURNAL_ARCHIVE {
+		this.records = append(this.records, rec)
+	}
+	if rec.Task != nil && rec.Type != JOURNAL_ASSIGN && rec.Type != JOURNAL_LOST {
+		this.details.Usage.Add(rec.Task.Result)
+	}
+
+	switch rec.Type {
+	case JOURNAL_SUBMIT:
+		this.details = *rec.Details
+		this.tasks = rec.Tasks
+	case JOURNAL_DETAILS:
+		progress, usage := this.details.Progress, this.details.Usage
+		this.details = *rec.Details
+		this.details.Progress, this.details.Usage = progress, usage
+	case JOURNAL_ARCHIVE:
+		this.details = *rec.Details
+		this.archived = true
+	case JOURNAL_ASSIGN:
+		delete(this.requeued, rec.Task.JobId)
+		delete(this.lost, rec.Task.JobId)
+		this.assigned[rec.Task.JobId] = rec
+		this.taskRecords[rec.Task.JobId] = &TaskRecord{SubId: rec.Task.SubId, TaskId: rec.Task.JobId, LineId: rec.Task.LineId,
+			Args: rec.Task.Args, State: TASK_RUNNING, NodeId: rec.NodeId, Host: rec.Host, Attempt: rec.Task.Attempt, Started: rec.Time}
+	case JOURNAL_FINISH:
+		delete(this.assigned, rec.Task.JobId)
+		this.ended[rec.Task.JobId] = true
+		this.details.Progress.Finished++
+		this.taskStopped(rec, TASK_FINISHED)
+	case JOURNAL_RETRY:
+		delete(this.assigned, rec.Task.JobId)
+		delete(this.lost, rec.Task.JobId)
+		this.requeued[rec.Task.JobId] = rec.Task
+		this.details.Progress.Retried++
+		if rec.Task.TimedOut {
+			this.details.Progress.TimedOut++
+		}
+		this.taskStopped(rec, TASK_QUEUED)
+	case JOURNAL_ERROR:
+		delete(this.assigned, rec.Task.JobId)
+		delete(this.requeued, rec.Task.JobId)
+		this.ended[rec.Task.JobId] = true
+		this.details.Progress.Errored++
+		if rec.Task.TimedOut {
+			this.details.Progress.TimedOut++
+		}
+		this.taskStopped(rec, TASK_ERRORED)
+	case JOURNAL_LOST:
+		delete(this.assigned, rec.Task.JobId)
+		this.requeued[rec.Task.JobId] = rec.Task
+		this.lost[rec.Task.JobId] = true
+		this.taskStopped(rec, TASK_QUEUED)
+		this.taskRecords[rec.Task.JobId].Error = "node lost"
+	}
+}
+
+// updates a task's record the way Submission.TaskStopped does
+func (this *journaledJob) taskStopped(rec JournalRecord, state string) {
+	wj := rec.Task
+	tr, isin := this.taskRecords[wj.JobId]
+	if !isin {
+		tr = &TaskRecord{SubId: wj.SubId, TaskId: wj.JobId, LineId: wj.LineId, Args: wj.Args, Attempt: wj.Attempt}
+		this.taskRecords[wj.JobId] = tr
+	}
+	tr.State = state
+	tr.Ended = rec.Time
+	if state != TASK_FINISHED {
+		tr.Error = wj.Error
+	}
+	tr.Result = wj.Result
+}
+
+// reads the journal at path, rebuilds the submissions it describes and reopens it for appending.  the file is
+// rewritten first so archived jobs shrink to their final details.  tasks that were on a node when the master went
+// down are held as if the node had just disconnected, so a worker that reconnects within reconnectGrace keeps them.
+func (m *Master) RestoreFromJournal(path string) {
+	logger.Printf("RestoreFromJournal(%v)", path)
+	order, jobs, nodes := readJournal(path)
+	if err := rewriteJournal(path, order, jobs, nodes); err != nil {
+		logger.Warn(err)
+	}
+
+	// no node is connected to a master that just started
+	for nodeId, rec := range nodes {
+		rec.Online = false
+		m.registry[nodeId] = rec
+	}
+
+	lost := map[string]*NodeHandle{}
+	for _, jobId := range order {
+		job := jobs[jobId]
+		if job.archived {
+			m.archive(jobId, job.details)
+			continue
+		}
+		m.restoreSubmission(job, lost)
+	}
+	for _, nh := range lost {
+		go m.HoldLostNode(nh)
+	}
+
+	j, err := OpenJournal(path)
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	journal = j
+	logger.Printf("RestoreFromJournal(%v): %d jobs, %d archived, %d nodes", path, len(m.subMap), len(m.archived), len(nodes))
+}
+
+// replays the journal at path into the jobs it describes, in the order they were submitted, and the latest record
+// of each node
+func readJournal(path string) (order []string, jobs map[string]*journaledJob, nodes map[string]*NodeRecord) {
+	file, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn(err)
+		}
+		return replayJournal(strings.NewReader(""))
+	}
+	defer file.Close()
+	return replayJournal(file)
+}
+
+// replays journal records read from r, see readJournal
+func replayJournal(r io.Reader) (order []string, jobs map[string]*journaledJob, nodes map[string]*NodeRecord) {
+	order = make([]string, 0)
+	jobs = map[string]*journaledJob{}
+	nodes = map[string]*NodeRecord{}
+
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec JournalRecord
+		if err := decoder.Decode(&rec); err != nil {
+			if err != io.EOF {
+				logger.Warn(err)
+			}
+			break
+		}
+
+		if rec.Type == JOURNAL_NODE {
+			if rec.Node != nil {
+				nodes[rec.NodeId] = rec.Node
+			}
+			continue
+		}
+
+		job, isin := jobs[rec.JobId]
+		if !isin {
+			if rec.Type != JOURNAL_SUBMIT && rec.Type != JOURNAL_ARCHIVE {
+				continue
+			}
+			job = &journaledJob{ended: map[int]bool{}, assigned: map[int]JournalRecord{}, requeued: map[int]*WorkerJob{},
+				lost: map[int]bool{}, taskRecords: map[int]*TaskRecord{}}
+			jobs[rec.JobId] = job
+			order = append(order, rec.JobId)
+		}
+		job.apply(rec)
+	}
+	return
+}
+
+// writes the records of unarchived jobs, one record with the final details of each of the newest maxArchived
+// archived jobs, and the latest record of each node to path
+func rewriteJournal(path string, order []string, jobs map[string]*journaledJob, nodes map[string]*NodeRecord) error {
+	file, err := writeCompacted(path, order, jobs, nodes)
+	if err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	return os.Rename(path+".tmp", path)
+}
+
+// writes what rewriteJournal keeps to path.tmp and returns it still open
+func writeCompacted(path string, order []string, jobs map[string]*journaledJob, nodes map[string]*NodeRecord) (*os.File, error) {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	// like Master.archive, only the newest maxArchived archived jobs are kept
+	forget := -maxArchived
+	for _, jobId := range order {
+		if jobs[jobId].archived {
+			forget++
+		}
+	}
+
+	encoder := json.NewEncoder(file)
+	for _, jobId := range order {
+		job := jobs[jobId]
+		records := job.records
+		if job.archived && forget > 0 {
+			forget--
+			continue
+		}
+		if job.archived {
+			records = []JournalRecord{JournalRecord{Type: JOURNAL_ARCHIVE, JobId: jobId, Details: &job.details}}
+		}
+		for _, rec := range records {
+			if err = encoder.Encode(rec); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+	}
+	for nodeId, node := range nodes {
+		if err = encoder.Encode(JournalRecord{Type: JOURNAL_NODE, NodeId: nodeId, Node: node}); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// seconds left of a restored job's timeout, counted from when it started running before the master went down
+func remainingTimeout(dtls JobDetails) int {
+	if dtls.RunningSince == 0 {
+		return dtls.JobTimeout
+	}
+	remaining := dtls.JobTimeout - int(time.Now().Unix()-dtls.RunningSince)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// puts a journaled job back in the submission map, in the state it was in
+func (m *Master) restoreSubmission(job *journaledJob, lost map[string]*NodeHandle) {
+	dtls := job.details
+	skip := map[int]bool{}
+	for id := range job.ended {
+		skip[id] = true
+	}
+	for id := range job.assigned {
+		skip[id] = true
+	}
+	for id := range job.requeued {
+		skip[id] = true
+	}
+
+	if dtls.State != COMPLETE && dtls.Progress.isComplete() {
+		dtls.State = COMPLETE
+		dtls.Status = SUCCESS
+	}
+
+	// a finished job is restored as its details and task records only, it has no log to write or tasks to run
+	var s *Submission
+	if dtls.State == COMPLETE {
+		s = newSubmission(dtls, job.tasks)
+	} else {
+		s = NewSubmission(dtls, job.tasks)
+	}
+	s.queueMu.Lock()
+	s.skip = skip
+	s.held = dtls.State == WAITING
+	s.paused = dtls.State == PAUSED
+	s.stopped = dtls.State == COMPLETE
+	s.queueMu.Unlock()
+
+	s.recordMu.Lock()
+	s.records = job.taskRecords
+	s.recordMu.Unlock()
+
+	<-s.Details
+	s.Details <- dtls
+
+	m.subMu.Lock()
+	m.subMap[dtls.JobId] = s
+	m.subMu.Unlock()
+
+	if dtls.State == COMPLETE {
+		return
+	}
+
+	for id, wj := range job.requeued {
+		if job.lost[id] {
+			s.Return(wj)
+		} else {
+			s.RequeueRestored(wj)
+		}
+	}
+	for _, rec := range job.assigned {
+		nh, isin := lost[rec.NodeId]
+		if !isin {
+			nh = &NodeHandle{NodeId: rec.NodeId, Uri: "/nodes/" + rec.NodeId, assigned: map[string]*WorkerJob{}, dead: make(chan int)}
+			lost[rec.NodeId] = nh
+		}
+		nh.Assign(rec.Task)
+		s.queueMu.Lock()
+		s.inFlight++
+		s.queueMu.Unlock()
+		m.fairShare.Started(s.owner)
+	}
+
+	if dtls.State == WAITING {
+		go m.WaitForPrerequisites(dtls.JobId)
+	} else if dtls.JobTimeout > 0 {
+		go m.EnforceJobTimeout(dtls.JobId, remainingTimeout(dtls))
+	}
+	logger.Printf("restored job [%v, %v, %d in flight]", dtls.JobId, dtls.State, len(job.assigned))
+}
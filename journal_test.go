@@ -0,0 +1,238 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func submitRecord(jobId string, tasks int) JournalRecord {
+	dtls := NewJobDetails(jobId, "owner", jobId, "test", tasks, RUNNING, READY)
+	return JournalRecord{Type: JOURNAL_SUBMIT, JobId: jobId, Details: &dtls, Tasks: []Task{{Count: tasks}}}
+}
+
+func taskRecord(recType string, jobId string, taskId int) JournalRecord {
+	return JournalRecord{Type: recType, JobId: jobId, Task: &WorkerJob{SubId: jobId, JobId: taskId}, NodeId: "node"}
+}
+
+func detailsRecord(jobId string, priority int) JournalRecord {
+	dtls := NewJobDetails(jobId, "owner", jobId, "test", 3, RUNNING, READY)
+	dtls.Priority = priority
+	return JournalRecord{Type: JOURNAL_DETAILS, JobId: jobId, Details: &dtls}
+}
+
+func archiveRecord(jobId string) JournalRecord {
+	dtls := NewJobDetails(jobId, "owner", jobId, "test", 1, COMPLETE, SUCCESS)
+	return JournalRecord{Type: JOURNAL_ARCHIVE, JobId: jobId, Details: &dtls}
+}
+
+func encodeRecords(recs []JournalRecord) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	for _, rec := range recs {
+		encoder.Encode(rec)
+	}
+	return buf
+}
+
+func sortedIds(set interface{}) []int {
+	ids := make([]int, 0)
+	for _, key := range reflect.ValueOf(set).MapKeys() {
+		ids = append(ids, int(key.Int()))
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func TestReplayJournal(t *testing.T) {
+	tests := []struct {
+		name     string
+		records  []JournalRecord
+		assigned []int
+		requeued []int
+		lost     []int
+		ended    []int
+		progress TaskProgress
+	}{
+		{"finished", []JournalRecord{submitRecord("j", 3), taskRecord(JOURNAL_ASSIGN, "j", 0), taskRecord(JOURNAL_ASSIGN, "j", 1),
+			taskRecord(JOURNAL_FINISH, "j", 0)},
+			[]int{1}, []int{}, []int{}, []int{0}, TaskProgress{Total: 3, Finished: 1}},
+		{"retried", []JournalRecord{submitRecord("j", 3), taskRecord(JOURNAL_ASSIGN, "j", 0), taskRecord(JOURNAL_RETRY, "j", 0)},
+			[]int{}, []int{0}, []int{}, []int{}, TaskProgress{Total: 3, Retried: 1}},
+		{"errored", []JournalRecord{submitRecord("j", 3), taskRecord(JOURNAL_ASSIGN, "j", 0), taskRecord(JOURNAL_RETRY, "j", 0),
+			taskRecord(JOURNAL_ASSIGN, "j", 0), taskRecord(JOURNAL_ERROR, "j", 0)},
+			[]int{}, []int{}, []int{}, []int{0}, TaskProgress{Total: 3, Errored: 1, Retried: 1}},
+		{"lost", []JournalRecord{submitRecord("j", 3), taskRecord(JOURNAL_ASSIGN, "j", 0), taskRecord(JOURNAL_LOST, "j", 0)},
+			[]int{}, []int{0}, []int{0}, []int{}, TaskProgress{Total: 3}},
+		{"lost and reassigned", []JournalRecord{submitRecord("j", 3), taskRecord(JOURNAL_ASSIGN, "j", 0),
+			taskRecord(JOURNAL_LOST, "j", 0), taskRecord(JOURNAL_ASSIGN, "j", 0)},
+			[]int{0}, []int{}, []int{}, []int{}, TaskProgress{Total: 3}},
+		{"before submit", []JournalRecord{taskRecord(JOURNAL_ASSIGN, "j", 0), submitRecord("j", 3)},
+			[]int{}, []int{}, []int{}, []int{}, TaskProgress{Total: 3}},
+		{"details keep progress", []JournalRecord{submitRecord("j", 3), taskRecord(JOURNAL_ASSIGN, "j", 0),
+			taskRecord(JOURNAL_FINISH, "j", 0), detailsRecord("j", 5)},
+			[]int{}, []int{}, []int{}, []int{0}, TaskProgress{Total: 3, Finished: 1}},
+	}
+
+	for _, test := range tests {
+		order, jobs, _ := replayJournal(encodeRecords(test.records))
+		if !reflect.DeepEqual(order, []string{"j"}) {
+			t.Errorf("%v: replayed jobs %v, want [j]", test.name, order)
+			continue
+		}
+		job := jobs["j"]
+		if got := sortedIds(job.assigned); !reflect.DeepEqual(got, test.assigned) {
+			t.Errorf("%v: assigned %v, want %v", test.name, got, test.assigned)
+		}
+		if got := sortedIds(job.requeued); !reflect.DeepEqual(got, test.requeued) {
+			t.Errorf("%v: requeued %v, want %v", test.name, got, test.requeued)
+		}
+		if got := sortedIds(job.lost); !reflect.DeepEqual(got, test.lost) {
+			t.Errorf("%v: lost %v, want %v", test.name, got, test.lost)
+		}
+		if got := sortedIds(job.ended); !reflect.DeepEqual(got, test.ended) {
+			t.Errorf("%v: ended %v, want %v", test.name, got, test.ended)
+		}
+		if job.details.Progress != test.progress {
+			t.Errorf("%v: progress %+v, want %+v", test.name, job.details.Progress, test.progress)
+		}
+	}
+}
+
+// the lines in the journal at path
+func countRecords(t *testing.T, path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		lines++
+	}
+	return lines
+}
+
+func TestRewriteJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(kept int) { maxArchived = kept }(maxArchived)
+
+	tests := []struct {
+		maxArchived int
+		order       []string
+		records     int
+	}{
+		{10, []string{"a", "b", "c", "live"}, 3 + 2 + 1},
+		{2, []string{"b", "c", "live"}, 2 + 2 + 1},
+		{0, []string{"live"}, 2 + 1},
+	}
+	for _, test := range tests {
+		maxArchived = test.maxArchived
+		path := filepath.Join(dir, "journal")
+		recs := []JournalRecord{submitRecord("a", 1), taskRecord(JOURNAL_ASSIGN, "a", 0), archiveRecord("a"),
+			submitRecord("b", 1), archiveRecord("b"), submitRecord("c", 1), archiveRecord("c"),
+			submitRecord("live", 2), taskRecord(JOURNAL_ASSIGN, "live", 0),
+			{Type: JOURNAL_NODE, NodeId: "node", Node: &NodeRecord{NodeId: "node", MaxJobs: 1}},
+			{Type: JOURNAL_NODE, NodeId: "node", Node: &NodeRecord{NodeId: "node", MaxJobs: 4}}}
+		if err := ioutil.WriteFile(path, encodeRecords(recs).Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		order, jobs, nodes := readJournal(path)
+		if err := rewriteJournal(path, order, jobs, nodes); err != nil {
+			t.Fatal(err)
+		}
+		order, jobs, nodes = readJournal(path)
+		if !reflect.DeepEqual(order, test.order) {
+			t.Errorf("maxArchived %d: kept jobs %v, want %v", test.maxArchived, order, test.order)
+		}
+		if got := countRecords(t, path); got != test.records {
+			t.Errorf("maxArchived %d: %d records, want %d", test.maxArchived, got, test.records)
+		}
+		if len(jobs["live"].assigned) != 1 || nodes["node"].MaxJobs != 4 {
+			t.Errorf("maxArchived %d: live job or node not kept as it was", test.maxArchived)
+		}
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "journal")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Record(submitRecord("old", 2))
+	for i := 0; i < 2; i++ {
+		j.Record(taskRecord(JOURNAL_ASSIGN, "old", i))
+		j.Record(taskRecord(JOURNAL_FINISH, "old", i))
+	}
+	j.Record(archiveRecord("old"))
+	j.Record(submitRecord("live", 100))
+
+	// records written while it compacts are copied over after the rest is rewritten
+	done := make(chan int)
+	go func() {
+		j.compact()
+		done <- 1
+	}()
+	for i := 0; i < 100; i++ {
+		j.Record(taskRecord(JOURNAL_ASSIGN, "live", i))
+	}
+	<-done
+	j.Record(taskRecord(JOURNAL_FINISH, "live", 0))
+
+	j.mu.Lock()
+	size := j.size
+	j.mu.Unlock()
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != size {
+		t.Errorf("journal is %d bytes on disk, counted %d", info.Size(), size)
+	}
+	if got := countRecords(t, path); got != 1+1+100+1 {
+		t.Errorf("compacted journal has %d records, want %d", got, 1+1+100+1)
+	}
+
+	order, jobs, _ := readJournal(path)
+	if !reflect.DeepEqual(order, []string{"old", "live"}) || !jobs["old"].archived {
+		t.Fatalf("compacted journal replays as %v", order)
+	}
+	if live := jobs["live"]; len(live.assigned) != 99 || live.details.Progress.Finished != 1 {
+		t.Errorf("live job replays with %d assigned and %d finished, want 99 and 1", len(live.assigned), live.details.Progress.Finished)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// the contents of the lease file shared by an active master and its standbys.  masters only compare times taken
+// from their own clocks, so they don't need synchronized clocks: the holder counts from its last successful
+// renewal, a standby from when it last saw the lease change.
+type Lease struct {
+	Holder  string // hostname and id of the master holding the lease
+	Renewed int64  // unix time the holder last renewed it, by the holder's clock, changes with every renewal
+}
+
+// closed once this master can no longer be sure it holds the lease, it hands out no tasks after that
+var fenced = make(chan int)
+var fenceOnce sync.Once
+
+// true once the master has fenced itself off
+func Fenced() bool {
+	select {
+	case <-fenced:
+		return true
+	default:
+		return false
+	}
+}
+
+// stops dispatching and exits, so a standby that takes the lease over never dispatches alongside this master
+func fence(reason string) {
+	fenceOnce.Do(func() {
+		logger.Printf("fence(): %v, no longer dispatching", reason)
+		close(fenced)
+	})
+	DieIn(0)
+}
+
+func readLease(path string) (lease Lease, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	err = json.NewDecoder(file).Decode(&lease)
+	return
+}
+
+// replaces the lease file in one rename so readers never see half a lease
+func writeLease(path string, lease Lease) error {
+	file, err := os.Create(path + "." + lease.Holder)
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(file).Encode(lease); err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+"."+lease.Holder, path)
+}
+
+// blocks until this master holds the lease at path, which happens once this standby hasn't seen the lease renewed
+// for leaseTimeout seconds.  a master waiting here is a standby, it doesn't listen for workers or requests.
+func AcquireLease(path string, holder string) {
+	logger.Printf("AcquireLease(%v, %v)", path, holder)
+	interval := time.Duration(leaseTimeout) * time.Second / 3
+	var seen Lease
+	lastChange := time.Now()
+	for {
+		lease, err := readLease(path)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Warn(err)
+		}
+		if err == nil && lease != seen {
+			seen = lease
+			lastChange = time.Now()
+		}
+		stale := time.Since(lastChange) > time.Duration(leaseTimeout)*time.Second
+
+		if os.IsNotExist(err) || lease.Holder == holder || stale {
+			if err = writeLease(path, Lease{Holder: holder, Renewed: time.Now().Unix()}); err != nil {
+				logger.Warn(err)
+			} else {
+				// another standby may have written at the same moment, the last rename wins
+				<-time.After(time.Second)
+				if lease, err = readLease(path); err == nil && lease.Holder == holder {
+					logger.Printf("AcquireLease(): active master [%v]", holder)
+					return
+				}
+			}
+		}
+
+		logger.Debug("AcquireLease(): standing by, lease held by %v", lease.Holder)
+		<-time.After(interval)
+	}
+}
+
+// renews the lease every leaseTimeout/3 seconds.  if another master has taken it over this one fences itself
+// off.  so does a master that hasn't renewed the lease for two thirds of leaseTimeout, for instance because the
+// shared directory went away or hangs, since a standby may take it over once leaseTimeout has passed.
+func HoldLease(path string, holder string) {
+	interval := time.Duration(leaseTimeout) * time.Second / 3
+	renewed := make(chan time.Time, 1)
+	renewed <- time.Now()
+	go fenceUnlessRenewed(renewed, time.Duration(leaseTimeout)*time.Second-interval)
+
+	for {
+		<-time.After(interval)
+		lease, err := readLease(path)
+		if err == nil && lease.Holder != holder {
+			fence("lease taken over by " + lease.Holder)
+		}
+		if err != nil {
+			logger.Warn(err)
+			continue
+		}
+		if err = writeLease(path, Lease{Holder: holder, Renewed: time.Now().Unix()}); err != nil {
+			logger.Warn(err)
+			continue
+		}
+		<-renewed
+		renewed <- time.Now()
+	}
+}
+
+// fences the master off once the lease hasn't been renewed for limit, checked every second so a renewal that
+// hangs on the shared directory can't hold it up
+func fenceUnlessRenewed(renewed chan time.Time, limit time.Duration) {
+	for {
+		<-time.After(time.Second)
+		last := <-renewed
+		renewed <- last
+		if since := time.Since(last); since > limit {
+			fence("lease not renewed for " + since.String())
+		}
+	}
+}
@@ -82,20 +82,48 @@ func GlobalLogger(configFile *goconf.ConfigFile) {
 
 // starts master service based on the given configuration file
 // required parameters:  default.hostname, default.password
-// optional parameters:  master.buffersize
+// optional parameters:  master.buffersize, master.priorityaging, master.shares, master.defaultshares, master.fairshareweight, master.fairsharehalflife,
+//                      master.maxattempts, master.retrybackoff, master.retryelsewhere, master.reconnectgrace, master.missedcheckins,
+//                      master.preferenceweight, master.journal, master.journalcompactsize, master.lease, master.leasetimeout, master.blobdir,
+//                      master.minfreememory, master.minfreedisk, master.minprotocolversion,
+//                      master.prerequisitewait, master.maxarchived, master.reserveafter
 func StartMaster(configFile *goconf.ConfigFile) {
 	SubIOBufferSize("master", configFile)
 	GoMaxProc("master", configFile)
 	ConBufferSize("master", configFile)
 	IOMOnitors(configFile)
+	PriorityAging(configFile)
+	FairShareConfig(configFile)
+	RetryDefaults(configFile)
+	ReconnectGrace(configFile)
+	MissedCheckins(configFile)
+	MinFreeResources(configFile)
+	MinProtocolVersion(configFile)
+	PrerequisiteLimits(configFile)
+	PreferenceWeight(configFile)
+	ReserveAfter(configFile)
+	JournalPath(configFile)
+	MasterLease(configFile)
+	BlobDir(configFile)
 
 	hostname := GetRequiredString(configFile, "default", "hostname")
 	password := GetRequiredString(configFile, "default", "password")
 
+	if leasePath != "" {
+		holder := hostname + "-" + UniqueId()
+		AcquireLease(leasePath, holder)
+		go HoldLease(leasePath, holder)
+	}
+
 	m := NewMaster()
+	m.blobs = NewBlobStore(blobDir)
+	if journalPath != "" {
+		m.RestoreFromJournal(journalPath)
+	}
 
 	rest.Resource("jobs", MasterJobController{m, password})
 	rest.Resource("nodes", MasterNodeController{m, password})
+	rest.Resource("blobs", MasterBlobController{m.blobs, password})
 
 	rest.ResourceContentType("jobs", "application/json")
 	rest.ResourceContentType("nodes", "application/json")
@@ -177,12 +205,19 @@ func StartAddama(configFile *goconf.ConfigFile) {
 }
 
 // starts worker based on the given configuration file
-// required parameters:  worker.masterhost
-// optional parameters:  worker.processes
+// required parameters:  worker.masterhost (comma separated to fail over between an active master and its standbys)
+// optional parameters:  worker.processes, worker.cores, worker.memory, worker.labels, worker.failovertimeout,
+//                      worker.stagedir, worker.killgrace, worker.nodeidfile
 func StartWorker(configFile *goconf.ConfigFile) {
 
 	GoMaxProc("worker", configFile)
 	ConBufferSize("worker", configFile)
+	WorkerResources(configFile)
+	WorkerLabels(configFile)
+	FailoverTimeout(configFile)
+	StageDir(configFile)
+	KillGrace(configFile)
+	NodeIdFile(configFile)
 	processes, err := configFile.GetInt("worker", "processes")
 	if err != nil {
 		logger.Warn(err)
@@ -23,23 +23,35 @@ import (
 	"code.google.com/p/go.net/websocket"
 	"net/http"
 	"sync"
+	"time"
 )
 
 type Master struct {
 	subMu       sync.RWMutex
 	subMap      map[string]*Submission //buffered channel for creating jobs TODO: verify thread safety... should be okay since we only set once
-	jobChan     chan *WorkerJob        //buffered channel for creating jobs
 	subidChan   chan int               //buffered channel used to keep track of submissions
+	archived    map[string]JobDetails  //final details of archived jobs, kept for jobs that depend on them
+	archiveList []string               //archived job ids, oldest first, the oldest are forgotten past maxArchived
+	dispatchMu  sync.Mutex             //serializes dispatch decisions made by NextJob
+	fairShare   *FairShare             //recent usage by job owner
 	nodeMu      sync.RWMutex
 	NodeHandles map[string]*NodeHandle
+	lostMu      sync.Mutex
+	lostNodes   map[string]*NodeHandle //disconnected nodes whose tasks are held for reconnectGrace seconds
+	blobs       *BlobStore             //files workers fetch for task inputs
+	registryMu  sync.Mutex
+	registry    map[string]*NodeRecord //every node seen, by node id, including those offline
 }
 
 //create a master node and initialize its channels
 func NewMaster() *Master {
 	m := &Master{
 		subMap:      map[string]*Submission{},
-		jobChan:     make(chan *WorkerJob, 0),
-		NodeHandles: map[string]*NodeHandle{}}
+		archived:    map[string]JobDetails{},
+		fairShare:   NewFairShare(),
+		NodeHandles: map[string]*NodeHandle{},
+		lostNodes:   map[string]*NodeHandle{},
+		registry:    map[string]*NodeRecord{}}
 	http.Handle("/master/", websocket.Handler(func(ws *websocket.Conn) { m.Listen(ws) }))
 	return m
 }
@@ -54,12 +66,42 @@ func (m *Master) GetSub(subId string) *Submission {
 func (m *Master) Listen(ws *websocket.Conn) {
 	logger.Printf("Listen(%v): node connecting", ws.LocalAddr().String())
 	nh := NewNodeHandle(NewConnection(ws, false), m)
+	if nh == nil {
+		logger.Printf("Listen(%v): handshake failed", ws.LocalAddr().String())
+		ws.Close()
+		return
+	}
 	logger.Printf("Adding Node to Map (%v)", ws.LocalAddr().String())
 	m.nodeMu.Lock()
+	previous := m.NodeHandles[nh.NodeId]
+	if previous != nil && previous.InUse() && !previous.Con.SameWorker(nh.hello) {
+		m.nodeMu.Unlock()
+		m.RefuseDuplicate(nh)
+		ws.Close()
+		return
+	}
 	m.NodeHandles[nh.NodeId] = nh
 	m.nodeMu.Unlock()
+
+	m.lostMu.Lock()
+	if lost, isin := m.lostNodes[nh.NodeId]; isin {
+		previous = lost
+		delete(m.lostNodes, nh.NodeId)
+	}
+	m.lostMu.Unlock()
+	var previousCon *Connection
+	if previous != nil {
+		previousCon = &previous.Con
+	}
+	nh.Con.Accept(nh.hello, previousCon, Welcome{Protocol: nh.Protocol, Capabilities: nh.Capabilities})
+	if previous != nil {
+		m.Reconcile(previous, nh)
+	}
+	m.NodeConnected(nh)
+	m.CheckSchedulable()
 	logger.Printf("Calling Remove Node on Death (%v)", ws.LocalAddr().String())
 	go m.RemoveNodeOnDeath(nh)
+	go nh.MonitorHeartbeat()
 
 	for i := 0; i < iomonitors; i++ {
 		logger.Printf("Starting IOMonitor %v (%v)", i, ws.LocalAddr().String())
@@ -69,22 +111,158 @@ func (m *Master) Listen(ws *websocket.Conn) {
 	nh.Monitor()
 }
 
-// sends a message to every connected worker
+// turns away a worker that presents the node id of another worker that is still connected and checking in.  the
+// worker backs off and tries again, by then a stale connection has gone quiet and is taken over.
+func (m *Master) RefuseDuplicate(nh *NodeHandle) {
+	reason := "node id " + nh.NodeId + " is in use by a connected worker"
+	logger.Printf("refusing %v [%v]: %v", nh.Hostname, nh.NodeId, reason)
+	m.nodeEvent(nh.NodeId, "refused", reason, nil)
+	if err := nh.Con.SendDirect(WorkerMessage{Type: REFUSED, ErrMsg: reason}); err != nil {
+		logger.Warn(err)
+	}
+}
+
+// sends a message to every connected worker. the map is copied first so the lock isn't held while waiting on
+// node monitors, which need it to pick their next job
 func (m *Master) Broadcast(msg *WorkerMessage) {
 	m.nodeMu.RLock()
-	logger.Debug("Broadcast(%v): to %v nodes", *msg, len(m.NodeHandles))
+	handles := make([]*NodeHandle, 0, len(m.NodeHandles))
 	for _, nh := range m.NodeHandles {
-		nh.BroadcastChan <- msg
+		handles = append(handles, nh)
 	}
 	m.nodeMu.RUnlock()
+
+	logger.Debug("Broadcast(%v): to %v nodes", *msg, len(handles))
+	for _, nh := range handles {
+		select {
+		case nh.BroadcastChan <- msg:
+		case <-nh.dead:
+		}
+	}
 	logger.Debug("Broadcast(): done")
 }
 
-// remove node handles from the map used to store them as they disconnect
+// the ids of the currently connected nodes
+func (m *Master) NodeIds() []string {
+	m.nodeMu.RLock()
+	defer m.nodeMu.RUnlock()
+	ids := make([]string, 0, len(m.NodeHandles))
+	for id := range m.NodeHandles {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// remove node handles from the map used to store them as they disconnect.  the node's tasks are held for
+// reconnectGrace seconds in case it comes back, after that they are put back on their submissions' queues.
 func (m *Master) RemoveNodeOnDeath(nh *NodeHandle) {
 	logger.Debug("RemoveNodeOnDeath(%v)", nh.NodeId)
 	<-nh.Con.DiedChan
+	nh.Close()
 	m.nodeMu.Lock()
-	delete(m.NodeHandles, nh.NodeId)
+	current := m.NodeHandles[nh.NodeId] == nh
+	if current {
+		delete(m.NodeHandles, nh.NodeId)
+	}
 	m.nodeMu.Unlock()
+	if current {
+		m.NodeDisconnected(nh)
+	}
+	m.CheckSchedulable()
+	m.HoldLostNode(nh)
+}
+
+// holds the tasks of a node that went away for reconnectGrace seconds, then puts them back on their submissions' queues
+// unless the node reconnected and reclaimed them
+func (m *Master) HoldLostNode(nh *NodeHandle) {
+	m.lostMu.Lock()
+	m.lostNodes[nh.NodeId] = nh
+	m.lostMu.Unlock()
+
+	logger.Printf("RemoveNodeOnDeath(%v): waiting %v secs for reconnect", nh.NodeId, reconnectGrace)
+	<-time.After(time.Duration(reconnectGrace) * time.Second)
+
+	m.lostMu.Lock()
+	lost := m.lostNodes[nh.NodeId] == nh
+	if lost {
+		delete(m.lostNodes, nh.NodeId)
+	}
+	m.lostMu.Unlock()
+
+	if lost {
+		for _, wj := range nh.TakeAssigned() {
+			m.RequeueLost(wj)
+		}
+	}
+}
+
+// hands the tasks of a node's previous connection over to its new one.  tasks the worker says it is
+// still running stay assigned to it, and so do tasks whose START the new connection is replaying to the same
+// worker process, those take up slots on the new handle.  the rest were lost along with the old connection and
+// are requeued.
+func (m *Master) Reconcile(previous *NodeHandle, nh *NodeHandle) {
+	logger.Printf("Reconcile(%v): %d tasks reported running", nh.NodeId, len(nh.helloTasks))
+	previous.Close()
+	if previous.Con.Socket != nil && previous.Con.socket() != nh.Con.socket() {
+		previous.Con.socket().Close()
+	}
+
+	stillRunning := map[string]bool{}
+	for _, wj := range nh.helloTasks {
+		stillRunning[wj.Key()] = true
+	}
+	replayed := map[string]bool{}
+	for _, wj := range nh.Con.delivery.UnackedStarts() {
+		replayed[wj.Key()] = true
+	}
+
+	for _, wj := range previous.TakeAssigned() {
+		if stillRunning[wj.Key()] {
+			nh.Assign(wj)
+			delete(stillRunning, wj.Key())
+		} else if replayed[wj.Key()] {
+			logger.Debug("Reconcile(%v): START of %v is being replayed", nh.NodeId, wj.Key())
+			nh.Assign(wj)
+			nh.reserve(wj)
+		} else {
+			m.RequeueLost(wj)
+		}
+	}
+
+	// a task the master no longer has assigned here was requeued or already counted, so its run is killed and
+	// its result will be dropped
+	for _, wj := range nh.helloTasks {
+		if stillRunning[wj.Key()] {
+			logger.Printf("Reconcile(%v): worker is running unknown task %v, killing it", nh.NodeId, wj.Key())
+			task := wj
+			msg := WorkerMessage{Type: KILL, SubId: wj.SubId}
+			msg.BodyFromInterface(task)
+			nh.Con.OutChan <- msg
+		}
+	}
+}
+
+// stops the job if it is still running after its job timeout and kills its running tasks
+func (m *Master) EnforceJobTimeout(jobId string, seconds int) {
+	logger.Debug("EnforceJobTimeout(%v, %d)", jobId, seconds)
+	<-time.After(time.Duration(seconds) * time.Second)
+
+	s := m.GetSub(jobId)
+	if s == nil {
+		return
+	}
+	if s.StopWithStatus(TIMEOUT) {
+		logger.Printf("job timed out after %d secs: %v", seconds, jobId)
+		m.Broadcast(&WorkerMessage{Type: KILL, SubId: jobId})
+	}
+}
+
+// puts a task that was lost with its node back on the queue without counting it as a failed attempt
+func (m *Master) RequeueLost(wj *WorkerJob) {
+	logger.Printf("requeueing lost task [%v]", wj.Key())
+	journal.Record(JournalRecord{Type: JOURNAL_LOST, JobId: wj.SubId, Task: wj})
+	m.TaskEnded(wj)
+	if s := m.GetSub(wj.SubId); s != nil {
+		s.Return(wj)
+	}
 }
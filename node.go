@@ -23,8 +23,12 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -71,7 +75,31 @@ func StartJob(cn *Connection, replyc chan *WorkerMessage, jsonjob string, jk *Jo
 	con := *cn
 
 	job := NewWorkerJob(jsonjob)
+
+	// tasks with inputs get a directory of their own, which is also their working directory unless they set one
+	workDir, taskDir := job.WorkingDir, ""
+	if len(job.Inputs) > 0 {
+		dir, err := StageTaskInputs(cn.MasterHost(), job)
+		if dir != "" {
+			defer os.RemoveAll(dir)
+		}
+		if err != nil {
+			con.OutChan <- WorkerMessage{Type: CERROR, SubId: job.SubId, Body: fmt.Sprintf("Error staging inputs: %s\n", err)}
+			logger.Warn(err)
+			replyc <- &WorkerMessage{Type: JOBERROR, SubId: job.SubId, Body: jsonjob, ErrMsg: err.Error()}
+			return
+		}
+		taskDir = dir
+		if workDir == "" {
+			workDir = dir
+		}
+	}
+
 	jobcmd := job.Args[0]
+	// a relative path to the command is relative to the task's working directory
+	if workDir != "" && strings.Contains(jobcmd, "/") && !filepath.IsAbs(jobcmd) {
+		jobcmd = filepath.Join(workDir, jobcmd)
+	}
 	//make sure the path to the exec is fully qualified
 	exepath, err := exec.LookPath(jobcmd)
 	if err != nil {
@@ -82,12 +110,18 @@ func StartJob(cn *Connection, replyc chan *WorkerMessage, jsonjob string, jk *Jo
 	}
 
 	args := job.Args[1:]
-	args = append(args, fmt.Sprintf("%v", job.SubId))
-	args = append(args, fmt.Sprintf("%v", job.LineId))
-	args = append(args, fmt.Sprintf("%v", job.JobId))
+	if !job.IdEnv {
+		args = append(args, fmt.Sprintf("%v", job.SubId))
+		args = append(args, fmt.Sprintf("%v", job.LineId))
+		args = append(args, fmt.Sprintf("%v", job.JobId))
+	}
 
 	//start the job in test dir pass all stdio back to main.  note that cmd has to be the first thing in the args array
 	cmd := exec.Command(exepath, args...)
+	cmd.Dir = workDir
+	cmd.Env = TaskEnv(job, taskDir)
+	// a process group of its own lets a kill reach everything the task started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
 	outpipe, err := cmd.StdoutPipe()
 	if err != nil {
@@ -105,6 +139,7 @@ func StartJob(cn *Connection, replyc chan *WorkerMessage, jsonjob string, jk *Jo
 	cerrorchan := make(chan int, 0)
 	go PipeToChan(errpipe, CERROR, job.SubId, con.OutChan, cerrorchan, "TASK : \""+exepath+strings.Join(args, " ")+"\" ERRORED: \n")
 
+	started := time.Now()
 	if err = cmd.Start(); err != nil {
 		logger.Warn(err)
 		replyc <- &WorkerMessage{Type: JOBERROR, SubId: job.SubId, Body: jsonjob, ErrMsg: err.Error()}
@@ -117,66 +152,191 @@ func StartJob(cn *Connection, replyc chan *WorkerMessage, jsonjob string, jk *Jo
 		jk.Donechan <- kb
 	}()
 
+	// the timeout only counts if it fires before the task has exited on its own
+	var timeoutMu sync.Mutex
+	exited, timedOut := false, false
+	if job.Timeout > 0 {
+		timer := time.AfterFunc(time.Duration(job.Timeout)*time.Second, func() {
+			timeoutMu.Lock()
+			if exited {
+				timeoutMu.Unlock()
+				return
+			}
+			timedOut = true
+			timeoutMu.Unlock()
+			logger.Printf("task timed out after %d secs: %v", job.Timeout, job.Key())
+			jk.Terminate(kb)
+		})
+		defer timer.Stop()
+	}
+
 	<-coutchan
 	<-cerrorchan
-	if err = cmd.Wait(); err != nil {
+	err = cmd.Wait()
+	job.Result = NewTaskResult(cmd.ProcessState, time.Since(started))
+	timeoutMu.Lock()
+	exited = true
+	timeoutMu.Unlock()
+
+	if len(job.Outputs) > 0 {
+		SendOutputs(cn, job, workDir)
+	}
+
+	if timedOut {
+		job.TimedOut = true
+		errMsg := fmt.Sprintf("task timed out after %d seconds", job.Timeout)
+		con.OutChan <- WorkerMessage{Type: CERROR, SubId: job.SubId, Body: "TASK : \"" + exepath + strings.Join(args, " ") + "\" " + errMsg + "\n"}
+		reply := &WorkerMessage{Type: JOBERROR, SubId: job.SubId, ErrMsg: errMsg}
+		reply.BodyFromInterface(job)
+		replyc <- reply
+		return
+	}
+
+	if err != nil {
 		logger.Warn(err)
-		replyc <- &WorkerMessage{Type: JOBERROR, SubId: job.SubId, Body: jsonjob, ErrMsg: err.Error()}
+		reply := &WorkerMessage{Type: JOBERROR, SubId: job.SubId, ErrMsg: err.Error()}
+		reply.BodyFromInterface(job)
+		replyc <- reply
 		return
 	}
 
 	logger.Printf("finishing job %v", job.JobId)
-	replyc <- &WorkerMessage{Type: JOBFINISHED, SubId: job.SubId, Body: jsonjob}
+	reply := &WorkerMessage{Type: JOBFINISHED, SubId: job.SubId}
+	reply.BodyFromInterface(job)
+	replyc <- reply
+}
+
+// the worker's environment plus the task's own variables and its ids as GOLEM_JOB_ID, GOLEM_LINE_ID, GOLEM_TASK_ID
+// and GOLEM_ATTEMPT, and GOLEM_TASK_DIR for tasks with inputs
+func TaskEnv(job *WorkerJob, taskDir string) []string {
+	env := os.Environ()
+	for name, value := range job.Env {
+		env = append(env, name+"="+value)
+	}
+	env = append(env, "GOLEM_JOB_ID="+job.SubId)
+	env = append(env, fmt.Sprintf("GOLEM_LINE_ID=%d", job.LineId))
+	env = append(env, fmt.Sprintf("GOLEM_TASK_ID=%d", job.JobId))
+	env = append(env, fmt.Sprintf("GOLEM_ATTEMPT=%d", job.Attempt))
+	if taskDir != "" {
+		env = append(env, "GOLEM_TASK_DIR="+taskDir)
+	}
+	return env
+}
+
+// the exit status and resource usage of a task's process once it has been waited for
+func NewTaskResult(state *os.ProcessState, wallTime time.Duration) *TaskResult {
+	result := &TaskResult{ExitCode: -1, WallTime: wallTime.Seconds()}
+	if state == nil {
+		return result
+	}
+
+	result.UserCpu = state.UserTime().Seconds()
+	result.SysCpu = state.SystemTime().Seconds()
+	if status, ok := state.Sys().(syscall.WaitStatus); ok {
+		if status.Exited() {
+			result.ExitCode = status.ExitStatus()
+		}
+		if status.Signaled() {
+			result.Signal = status.Signal().String()
+		}
+	}
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		result.MaxRssKB = int64(rusage.Maxrss)
+	}
+	return result
 }
 
 func CheckIn(c *Connection) {
 	logger.Debug("CheckIn(%v)", c.isWorker)
 	con := *c
 	for {
-		<-time.After(time.Duration(60) * time.Second)
+		<-time.After(time.Duration(checkinInterval) * time.Second)
 		logger.Debug("CheckIn(%v) after sleep", c.isWorker)
-		con.OutChan <- WorkerMessage{Type: CHECKIN}
+		msg := WorkerMessage{Type: CHECKIN}
+		msg.BodyFromInterface(CurrentHealth())
+		con.OutChan <- msg
+	}
+}
+
+// the HELLO a worker sends when it connects or reconnects, listing the tasks it is still running so the master
+// can tell which of the tasks it assigned here were lost.  tasks whose results haven't been acknowledged, or are
+// still waiting to be sent, count as running, their results are replayed once the master answers.
+func NewHelloMessage(processes int, nodeId string, runningJobs map[string]*WorkerJob, con *Connection) WorkerMessage {
+	tasks := make([]WorkerJob, 0, len(runningJobs))
+	for _, job := range runningJobs {
+		tasks = append(tasks, *job)
 	}
+	for _, job := range con.ReportedTasks() {
+		if _, isin := runningJobs[job.Key()]; !isin {
+			tasks = append(tasks, *job)
+		}
+	}
+	handshake := con.delivery.Handshake()
+
+	hostname, system, kernel := HostInventory()
+	wm := WorkerMessage{Type: HELLO}
+	wm.BodyFromInterface(HelloMsgBody{JobCapacity: processes, RunningJobs: len(tasks), UniqueId: nodeId, RunningTasks: tasks,
+		Cores: workerCores, Memory: workerMemory, Labels: workerLabels,
+		Hostname: hostname, OS: system, Kernel: kernel, Version: golemVersion, Health: CurrentHealth(), Delivery: &handshake,
+		Protocol: protocolVersion, Capabilities: capabilities})
+	return wm
 }
 
+// runs a worker node for the comma separated list of masters, the active master and its standbys
 func RunNode(processes int, master string) {
-	running := 0
+	runningJobs := map[string]*WorkerJob{}
+	nodeId := PersistentNodeId(nodeIdFile)
 
-	jk := NewJobKiller()
-	logger.Debug("Running as %d process node owned by %v", processes, master)
+	logger.Debug("Running as %d process node %v owned by %v", processes, nodeId, master)
 
-	ws := OpenWebSocketToMaster(master)
+	masters := make([]string, 0)
+	for _, m := range strings.Split(master, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			masters = append(masters, m)
+		}
+	}
 
-	mcon := *NewConnection(ws, true)
-	wm := WorkerMessage{Type: HELLO}
-	wm.BodyFromInterface(HelloMsgBody{JobCapacity: processes, RunningJobs: 0})
+	mcon := NewWorkerConnection(masters)
+	jk := NewJobKiller(mcon.OutChan)
+	wm := NewHelloMessage(processes, nodeId, runningJobs, mcon)
 	logger.Printf("Hello msg body: %v", wm.Body)
-	mcon.OutChan <- wm
-	go CheckIn(&mcon)
+	mcon.delivery.AwaitWelcome(mcon.socket())
+	if err := mcon.SendDirect(wm); err != nil {
+		logger.Warn(err)
+	}
+	go CheckIn(mcon)
 	replyc := make(chan *WorkerMessage)
 
 	for {
 		logger.Debug("Waiting for done or msg.")
 		select {
 		case <-mcon.DiedChan:
-			wm = WorkerMessage{Type: HELLO}
-			wm.BodyFromInterface(HelloMsgBody{JobCapacity: processes, RunningJobs: running})
-			mcon.ReConChan <- wm
+			mcon.ReConChan <- NewHelloMessage(processes, nodeId, runningJobs, mcon)
 		case rv := <-replyc:
 			logger.Debug("Got 'done' signal")
-			mcon.OutChan <- *rv
-			running--
+			if job := NewWorkerJob(rv.Body); job != nil {
+				mcon.Report(*rv, job)
+				delete(runningJobs, job.Key())
+			} else {
+				mcon.OutChan <- *rv
+			}
 
 		case msg := <-mcon.InChan:
 			logger.Debug("Got master msg")
 			switch msg.Type {
 			case START:
 				logger.Printf("START")
-				go StartJob(&mcon, replyc, msg.Body, jk)
-				running++
+				if job := NewWorkerJob(msg.Body); job != nil {
+					runningJobs[job.Key()] = job
+				}
+				go StartJob(mcon, replyc, msg.Body, jk)
 			case KILL:
-				logger.Printf("KILL: %v", msg.SubId)
-				jk.Killchan <- msg.SubId
+				logger.Printf("KILL: %v %v", msg.SubId, msg.Body)
+				if msg.Body == "" {
+					jk.Killchan <- msg.SubId
+				} else if job := NewWorkerJob(msg.Body); job != nil {
+					jk.KillTaskchan <- job
+				}
 			case RESTART:
 				logger.Printf("RESTART: %v", msg.SubId)
 				RestartIn(8)
@@ -21,19 +21,46 @@ package main
 
 import (
 	"encoding/json"
+	"sync"
 	"time"
 )
 
 type NodeHandle struct {
 	NodeId        string
 	Uri           string
-	Hostname      string
+	Hostname      string // the worker's own host name, or its address if it didn't send one
+	Address       string // the worker's end of the connection
 	Master        *Master
 	Con           Connection
-	MaxJobs       chan int
-	Running       chan int
+	MaxJobs       chan int // worker slots
+	Running       chan int // worker slots in use
+	MemoryInUse   chan int // MB requested by running tasks
 	Update        chan int
 	BroadcastChan chan *WorkerMessage
+	Cores         int
+	Memory        int // MB on the worker's machine, 0 if unknown
+	Labels        []string
+	OS            string
+	Kernel        string
+	Version       string
+	Protocol      int      // protocol version agreed with the worker
+	Capabilities  []string // what the worker and master agreed to use
+
+	assignMu   sync.Mutex
+	assigned   map[string]*WorkerJob // tasks sent to this node that it hasn't reported back on, by WorkerJob.Key()
+	helloTasks []WorkerJob           // tasks the worker said it was running when it said hello
+	hello      *HelloMsgBody         // what the worker said when it said hello
+	dead       chan int              // closed once the connection is gone
+	closeOnce  sync.Once
+
+	drainMu       sync.Mutex
+	draining      bool // takes no new tasks
+	drainShutdown bool // shuts down once its running tasks finish
+	shutdownSent  bool
+
+	seenMu   sync.Mutex
+	lastSeen time.Time   // when the node last sent a message
+	health   *NodeHealth // from the node's latest HELLO or CHECKIN, nil if it doesn't report it
 }
 
 func NewNodeHandle(n *Connection, m *Master) *NodeHandle {
@@ -43,12 +70,17 @@ func NewNodeHandle(n *Connection, m *Master) *NodeHandle {
 	nh := NodeHandle{NodeId: id,
 		Uri:           "/nodes/" + id,
 		Hostname:      con.Socket.RemoteAddr().String(),
+		Address:       con.Socket.RemoteAddr().String(),
 		Master:        m,
 		Con:           con,
 		MaxJobs:       make(chan int, 1),
 		Running:       make(chan int, 1),
+		MemoryInUse:   make(chan int, 1),
 		Update:        make(chan int, 10),
-		BroadcastChan: make(chan *WorkerMessage, 0)}
+		BroadcastChan: make(chan *WorkerMessage, 0),
+		assigned:      map[string]*WorkerJob{},
+		dead:          make(chan int),
+		lastSeen:      time.Now()}
 
 	//wait for worker handshake TODO: should this be in monitor???
 	nh.Running <- 0
@@ -62,17 +94,48 @@ func NewNodeHandle(n *Connection, m *Master) *NodeHandle {
 			logger.Warn(err)
 			return nil
 		}
+		protocol, agreed, err := Negotiate(val)
+		if err != nil {
+			logger.Printf("refusing %v [%v, %v]: %v", nh.Hostname, val.UniqueId, val.Hostname, err)
+			if val.UniqueId != "" {
+				m.nodeEvent(val.UniqueId, "refused", err.Error(), nil)
+			}
+			if err := nh.Con.SendDirect(WorkerMessage{Type: REFUSED, ErrMsg: err.Error()}); err != nil {
+				logger.Warn(err)
+			}
+			return nil
+		}
+		nh.Protocol = protocol
+		nh.Capabilities = agreed
 		nh.MaxJobs <- val.JobCapacity
 		if val.UniqueId != "" {
 			nh.NodeId = val.UniqueId
 			nh.Uri = "/nodes/" + val.UniqueId
-			<-nh.Running
-			nh.Running <- val.RunningJobs
 		}
-		if val.RunningJobs != 0 {
-			<-nh.Running
-			nh.Running <- val.RunningJobs
+
+		running, memoryInUse := val.RunningJobs, 0
+		if len(val.RunningTasks) > 0 {
+			running = 0
+			for _, wj := range val.RunningTasks {
+				running += wj.Slots()
+				memoryInUse += wj.Memory
+			}
 		}
+		<-nh.Running
+		nh.Running <- running
+		nh.MemoryInUse <- memoryInUse
+		nh.Cores = val.Cores
+		nh.Memory = val.Memory
+		nh.Labels = val.Labels
+		if val.Hostname != "" {
+			nh.Hostname = val.Hostname
+		}
+		nh.OS = val.OS
+		nh.Kernel = val.Kernel
+		nh.Version = val.Version
+		nh.health = val.Health
+		nh.helloTasks = val.RunningTasks
+		nh.hello = val
 	} else {
 		logger.Debug("%v didn't say hello as first message.", nh.Hostname)
 		return nil
@@ -90,6 +153,59 @@ func (nh *NodeHandle) Stats() (processes int, running int) {
 	return
 }
 
+// MB of memory requested by the tasks running on the node
+func (nh *NodeHandle) MemoryUsed() int {
+	inUse := <-nh.MemoryInUse
+	nh.MemoryInUse <- inUse
+	return inUse
+}
+
+// true if the node can do what the task needs and has enough free slots, and memory when both sides know it,
+// to run it
+func (nh *NodeHandle) Fits(wj *WorkerJob) bool {
+	if !nh.Capable(wj.Inputs, wj.Outputs) {
+		return false
+	}
+	processes, running := nh.Stats()
+	if wj.Slots() > processes-running {
+		return false
+	}
+	if nh.Memory > 0 && wj.Memory > 0 {
+		return wj.Memory <= nh.Memory-nh.MemoryUsed()
+	}
+	return true
+}
+
+// true if the node could run the task once enough of its own tasks end, regardless of what is free right now
+func (nh *NodeHandle) CouldFit(wj *WorkerJob) bool {
+	if !nh.Capable(wj.Inputs, wj.Outputs) {
+		return false
+	}
+	processes, _ := nh.Stats()
+	if wj.Slots() > processes {
+		return false
+	}
+	return nh.Memory == 0 || wj.Memory == 0 || wj.Memory <= nh.Memory
+}
+
+// takes up the slots and memory of a task sent to the node
+func (nh *NodeHandle) reserve(wj *WorkerJob) int {
+	running := <-nh.Running
+	nh.Running <- running + wj.Slots()
+	inUse := <-nh.MemoryInUse
+	nh.MemoryInUse <- inUse + wj.Memory
+	return running
+}
+
+// gives back the slots and memory of a task that ended
+func (nh *NodeHandle) release(wj *WorkerJob) int {
+	running := <-nh.Running
+	nh.Running <- running - wj.Slots()
+	inUse := <-nh.MemoryInUse
+	nh.MemoryInUse <- inUse - wj.Memory
+	return running
+}
+
 func (nh *NodeHandle) ReSize(newMaxJobs int) {
 	logger.Debug("ReSize(%d)", newMaxJobs)
 	<-nh.MaxJobs
@@ -105,29 +221,84 @@ func (nh *NodeHandle) SendJob(j *WorkerJob) {
 		logger.Warn(err)
 	}
 	msg := WorkerMessage{Type: START, Body: string(jobjson)}
+	nh.Assign(j)
+	nh.Master.GetSub(job.SubId).TaskStarted(j, nh.NodeId, nh.Hostname)
+	journal.Record(JournalRecord{Type: JOURNAL_ASSIGN, JobId: job.SubId, Task: j, NodeId: nh.NodeId, Host: nh.Hostname})
 	nh.Con.OutChan <- msg
-	running := <-nh.Running
-	nh.Running <- running + 1
+	running := nh.reserve(&job)
 	logger.Debug("assigning [%v, %d]", nh.Hostname, running)
 	nh.Master.GetSub(job.SubId).SubmittedChan <- &SubmitedWorkerJob{j, nh.Hostname}
 }
 
+// records that the task was sent to this node
+func (nh *NodeHandle) Assign(wj *WorkerJob) {
+	nh.assignMu.Lock()
+	defer nh.assignMu.Unlock()
+	nh.assigned[wj.Key()] = wj
+}
+
+// records that the node reported back on the task, returns false if it wasn't assigned here
+func (nh *NodeHandle) Unassign(wj *WorkerJob) bool {
+	nh.assignMu.Lock()
+	defer nh.assignMu.Unlock()
+	_, isin := nh.assigned[wj.Key()]
+	delete(nh.assigned, wj.Key())
+	return isin
+}
+
+// removes and returns every task assigned to this node
+func (nh *NodeHandle) TakeAssigned() []*WorkerJob {
+	nh.assignMu.Lock()
+	defer nh.assignMu.Unlock()
+	jobs := make([]*WorkerJob, 0, len(nh.assigned))
+	for _, wj := range nh.assigned {
+		jobs = append(jobs, wj)
+	}
+	nh.assigned = map[string]*WorkerJob{}
+	return jobs
+}
+
+// marks the handle dead so its monitors stop, safe to call more than once
+func (nh *NodeHandle) Close() {
+	nh.closeOnce.Do(func() { close(nh.dead) })
+}
+
+// true until the handle is closed
+func (nh *NodeHandle) Connected() bool {
+	select {
+	case <-nh.dead:
+		return false
+	default:
+		return true
+	}
+}
+
 func (nh *NodeHandle) Monitor() {
 	logger.Debug("Monitor(): [%v]", nh.Hostname)
 	//control loop
 	for {
+		select {
+		case <-nh.dead:
+			logger.Debug("Monitor(): [%v] connection closed", nh.Hostname)
+			return
+		default:
+		}
+
+		nh.ShutdownIfDrained()
 		processes, running := nh.Stats()
 		//logger.Debug("[%v %d %d]", nh.Hostname, processes, running)
 
 		switch {
 		case running < processes:
+			if job := nh.Master.NextJob(nh); job != nil {
+				nh.SendJob(job)
+				continue
+			}
 			//logger.Debug("waiting for job or message [%v, %d]", nh.Hostname, running)
 			select {
 			case bcMsg := <-nh.BroadcastChan:
 				logger.Debug("broadcasting [%v, %v]", nh.Hostname, *bcMsg)
 				nh.Con.OutChan <- *bcMsg
-			case job := <-nh.Master.jobChan:
-				nh.SendJob(job)
 			case <-nh.Update:
 			case <-time.After(time.Second):
 
@@ -150,18 +321,31 @@ func (nh *NodeHandle) Monitor() {
 func (nh *NodeHandle) MonitorIO() {
 	logger.Debug("MonitorIO(): [%v]", nh.Hostname)
 	for {
-		msg := <-nh.Con.InChan
-		nh.HandleWorkerMessage(&msg)
+		select {
+		case msg := <-nh.Con.InChan:
+			nh.HandleWorkerMessage(&msg)
+		case <-nh.dead:
+			return
+		}
 	}
 }
 
 //handle worker messages and updates the value in nh.Running if appropriate
 func (nh *NodeHandle) HandleWorkerMessage(msg *WorkerMessage) {
 	//logger.Debug("message from: %v", nh.Hostname)
+	nh.Seen()
 	switch msg.Type {
 	default:
 	case CHECKIN:
 		logger.Debug("CHECKIN [%v]", nh.Hostname)
+		if msg.Body != "" {
+			health := &NodeHealth{}
+			if err := json.Unmarshal([]byte(msg.Body), health); err != nil {
+				logger.Warn(err)
+				return
+			}
+			nh.SetHealth(health)
+		}
 	case COUT:
 		//logger.Debug("COUT [%v]", nh.Hostname)
 		blocked := true
@@ -186,23 +370,59 @@ func (nh *NodeHandle) HandleWorkerMessage(msg *WorkerMessage) {
 			}
 		}
 
+	case OUTPUT:
+		var chunk OutputChunk
+		if err := json.Unmarshal([]byte(msg.Body), &chunk); err != nil {
+			logger.Warn(err)
+			return
+		}
+		if s := nh.Master.GetSub(msg.SubId); s != nil {
+			s.WriteOutput(&chunk)
+		}
+
+	case KILLED:
+		var report KillReport
+		if err := json.Unmarshal([]byte(msg.Body), &report); err != nil {
+			logger.Warn(err)
+			return
+		}
+		logger.Printf("KILLED [%v, %v, %d, %v]", nh.Hostname, report.SubId, report.TaskId, report.Signal)
+		if s := nh.Master.GetSub(msg.SubId); s != nil {
+			s.TaskKilled(report.TaskId, report.Signal)
+		}
+
 	case JOBFINISHED:
 		go func() {
 			logger.Debug("JOBFINISHED [%v]", nh.Hostname)
-			running := <-nh.Running
-			nh.Running <- running - 1
+			wj := NewWorkerJob(msg.Body)
+			running := nh.release(wj)
 			logger.Debug("JOBFINISHED [%v, %v, %v]", nh.Hostname, msg.Body, running)
-			nh.Master.GetSub(msg.SubId).FinishedChan <- NewWorkerJob(msg.Body)
+			// a result for a task that isn't assigned here was already counted, or the task was requeued
+			if !nh.Unassign(wj) {
+				logger.Printf("JOBFINISHED [%v, %v]: task not assigned here, dropping result", nh.Hostname, wj.Key())
+				nh.Update <- 1
+				return
+			}
+			nh.Master.TaskEnded(wj)
+			nh.Master.GetSub(msg.SubId).FinishedChan <- wj
 			nh.Update <- 1
 			logger.Printf("JOBFINISHED [%v, %v, %v]", nh.Hostname, msg.Body, running)
 		}()
 	case JOBERROR:
 		go func() {
 			logger.Debug("JOBERROR %v", nh.Hostname)
-			running := <-nh.Running
-			nh.Running <- running - 1
+			wj := NewWorkerJob(msg.Body)
+			running := nh.release(wj)
 			logger.Debug("JOBERROR running [%v, %v, %v]", nh.Hostname, msg.Body, running)
-			nh.Master.GetSub(msg.SubId).ErrorChan <- NewWorkerJob(msg.Body)
+			wj.FailedOn = append(wj.FailedOn, nh.NodeId)
+			wj.Error = msg.ErrMsg
+			if !nh.Unassign(wj) {
+				logger.Printf("JOBERROR [%v, %v]: task not assigned here, dropping result", nh.Hostname, wj.Key())
+				nh.Update <- 1
+				return
+			}
+			nh.Master.TaskEnded(wj)
+			nh.Master.GetSub(msg.SubId).ErrorChan <- wj
 			nh.Update <- 1
 			logger.Printf("JOBERROR finished sent: [%v, %v, %v]", nh.Hostname, msg.Body, running)
 		}()
@@ -0,0 +1,88 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"testing"
+)
+
+// a node handle with slots running of maxJobs and memoryUsed of memory MB in use, not connected to anything
+func testNode(maxJobs int, running int, memory int, memoryUsed int, capabilities ...string) *NodeHandle {
+	nh := &NodeHandle{NodeId: "node", MaxJobs: make(chan int, 1), Running: make(chan int, 1), MemoryInUse: make(chan int, 1),
+		Memory: memory, Capabilities: capabilities}
+	nh.MaxJobs <- maxJobs
+	nh.Running <- running
+	nh.MemoryInUse <- memoryUsed
+	return nh
+}
+
+func TestNodeHandleFits(t *testing.T) {
+	staged := []TaskInput{{Name: "in", Blob: "abc"}}
+	tests := []struct {
+		name     string
+		nh       *NodeHandle
+		wj       WorkerJob
+		fits     bool
+		couldFit bool
+	}{
+		{"free slot", testNode(4, 3, 0, 0), WorkerJob{}, true, true},
+		{"full", testNode(4, 4, 0, 0), WorkerJob{}, false, true},
+		{"too few free slots", testNode(4, 2, 0, 0), WorkerJob{Cpus: 3}, false, true},
+		{"enough free slots", testNode(4, 1, 0, 0), WorkerJob{Cpus: 3}, true, true},
+		{"more slots than the node", testNode(4, 0, 0, 0), WorkerJob{Cpus: 5}, false, false},
+		{"free memory", testNode(4, 1, 8192, 4096), WorkerJob{Memory: 4096}, true, true},
+		{"memory in use", testNode(4, 1, 8192, 6144), WorkerJob{Memory: 4096}, false, true},
+		{"more memory than the node", testNode(4, 0, 8192, 0), WorkerJob{Memory: 16384}, false, false},
+		{"node memory unknown", testNode(4, 0, 0, 0), WorkerJob{Memory: 16384}, true, true},
+		{"task memory unknown", testNode(4, 0, 8192, 8192), WorkerJob{}, true, true},
+		{"inputs without staging", testNode(4, 0, 0, 0), WorkerJob{Inputs: staged}, false, false},
+		{"inputs with staging", testNode(4, 0, 0, 0, CAP_STAGING), WorkerJob{Inputs: staged}, true, true},
+		{"outputs without outputs", testNode(4, 0, 0, 0, CAP_STAGING), WorkerJob{Outputs: []string{"out"}}, false, false},
+		{"outputs with outputs", testNode(4, 0, 0, 0, CAP_OUTPUTS), WorkerJob{Outputs: []string{"out"}}, true, true},
+	}
+	for _, test := range tests {
+		if got := test.nh.Fits(&test.wj); got != test.fits {
+			t.Errorf("%v: Fits() = %v, want %v", test.name, got, test.fits)
+		}
+		if got := test.nh.CouldFit(&test.wj); got != test.couldFit {
+			t.Errorf("%v: CouldFit() = %v, want %v", test.name, got, test.couldFit)
+		}
+	}
+}
+
+func TestNodeHandleReserve(t *testing.T) {
+	nh := testNode(8, 0, 8192, 0)
+	tasks := []WorkerJob{{}, {Cpus: 2, Memory: 1024}, {Cpus: 4, Memory: 4096}}
+	for i := range tasks {
+		nh.reserve(&tasks[i])
+	}
+	if _, running := nh.Stats(); running != 7 || nh.MemoryUsed() != 5120 {
+		t.Errorf("reserved %d slots and %d MB, want 7 and 5120", running, nh.MemoryUsed())
+	}
+	if nh.Fits(&WorkerJob{Cpus: 2}) || !nh.Fits(&WorkerJob{Memory: 3072}) {
+		t.Errorf("Fits() doesn't count what was reserved")
+	}
+	for i := range tasks {
+		nh.release(&tasks[i])
+	}
+	if _, running := nh.Stats(); running != 0 || nh.MemoryUsed() != 0 {
+		t.Errorf("released back to %d slots and %d MB, want 0 and 0", running, nh.MemoryUsed())
+	}
+}
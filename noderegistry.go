@@ -0,0 +1,257 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// events kept in a node's history, older ones are dropped
+const nodeHistoryLength = 50
+
+// what the master remembers about a worker across its connections, kept after it goes offline
+type NodeRecord struct {
+	NodeId    string
+	Hostname  string
+	Address   string
+	Online    bool
+	FirstSeen string
+	LastSeen  string
+	MaxJobs   int  // slots set by a resize, 0 to use what the worker asks for
+	Draining  bool // takes no new tasks when it connects
+	Shutdown  bool // shuts down once drained
+	History   []NodeEvent
+}
+
+type NodeEvent struct {
+	Time   string
+	Event  string
+	Detail string
+}
+
+type NodeRecordList struct {
+	Items         []NodeRecord
+	NumberOfItems int
+}
+
+// orders node records by id
+type nodeRecords []NodeRecord
+
+func (this nodeRecords) Len() int           { return len(this) }
+func (this nodeRecords) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+func (this nodeRecords) Less(i, j int) bool { return this[i].NodeId < this[j].NodeId }
+
+// the open, locked file that gives this worker its node id, kept for the life of the process so the lock is held
+var nodeIdLock *os.File
+
+// the id this worker presents in every HELLO, read from path or, the first time, generated and saved there so
+// the worker keeps it across reconnects and restarts.  the worker holds an exclusive lock on the file, a second
+// worker started with the same file locks path.2 (then path.3 ...) instead and presents the id with -2 appended,
+// so workers sharing a directory keep distinct ids that also survive restarts.
+func PersistentNodeId(path string) string {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		logger.Warn(err)
+		return UniqueId()
+	}
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+		nodeIdLock = file
+		return readNodeId(file, path)
+	}
+	file.Close()
+
+	// the worker holding path writes the id right after locking it
+	nodeId := ""
+	for tries := 0; nodeId == "" && tries < 50; tries++ {
+		if data, err := ioutil.ReadFile(path); err == nil {
+			nodeId = strings.TrimSpace(string(data))
+		}
+		if nodeId == "" {
+			<-time.After(100 * time.Millisecond)
+		}
+	}
+	if nodeId == "" {
+		logger.Printf("PersistentNodeId(%v): locked but empty, using a new id", path)
+		return UniqueId()
+	}
+
+	for n := 2; ; n++ {
+		slot := path + "." + strconv.Itoa(n)
+		file, err := os.OpenFile(slot, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			logger.Warn(err)
+			return UniqueId()
+		}
+		if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+			nodeIdLock = file
+			logger.Printf("PersistentNodeId(%v): in use by another worker, locked %v", path, slot)
+			return nodeId + "-" + strconv.Itoa(n)
+		}
+		file.Close()
+	}
+}
+
+// the id saved in the locked id file, generated and saved the first time
+func readNodeId(file *os.File, path string) string {
+	if data, err := ioutil.ReadAll(file); err == nil {
+		if nodeId := strings.TrimSpace(string(data)); nodeId != "" {
+			return nodeId
+		}
+	} else {
+		logger.Warn(err)
+	}
+
+	nodeId := UniqueId()
+	if _, err := file.WriteAt([]byte(nodeId+"\n"), 0); err != nil {
+		logger.Warn(err)
+	} else if err = file.Sync(); err != nil {
+		logger.Warn(err)
+	}
+	logger.Printf("PersistentNodeId(%v): new node id %v", path, nodeId)
+	return nodeId
+}
+
+// adds an event to the node's record, creating the record if the node is new, and journals it.  change is
+// applied to the record under the registry lock.
+func (m *Master) nodeEvent(nodeId string, event string, detail string, change func(*NodeRecord)) NodeRecord {
+	m.registryMu.Lock()
+	defer m.registryMu.Unlock()
+
+	now := time.Now().String()
+	rec, isin := m.registry[nodeId]
+	if !isin {
+		rec = &NodeRecord{NodeId: nodeId, FirstSeen: now, History: make([]NodeEvent, 0)}
+		m.registry[nodeId] = rec
+	}
+	if change != nil {
+		change(rec)
+	}
+	rec.History = append(rec.History, NodeEvent{Time: now, Event: event, Detail: detail})
+	if len(rec.History) > nodeHistoryLength {
+		rec.History = rec.History[len(rec.History)-nodeHistoryLength:]
+	}
+
+	journaled := *rec
+	journal.Record(JournalRecord{Type: JOURNAL_NODE, NodeId: nodeId, Node: &journaled})
+	return *rec
+}
+
+// records that a node connected and gives it the size and drain state set for its id before
+func (m *Master) NodeConnected(nh *NodeHandle) {
+	rec := m.nodeEvent(nh.NodeId, "connected", nh.Hostname+" "+nh.Address, func(rec *NodeRecord) {
+		rec.Hostname = nh.Hostname
+		rec.Address = nh.Address
+		rec.Online = true
+		rec.LastSeen = time.Now().String()
+	})
+	if rec.MaxJobs > 0 {
+		nh.ReSize(rec.MaxJobs)
+	}
+	if rec.Draining {
+		nh.Drain(rec.Shutdown)
+	}
+}
+
+// records that a node's connection is gone
+func (m *Master) NodeDisconnected(nh *NodeHandle) {
+	m.nodeEvent(nh.NodeId, "disconnected", nh.Hostname+" "+nh.Address, func(rec *NodeRecord) {
+		rec.Online = false
+		rec.LastSeen = nh.LastSeen().String()
+	})
+}
+
+// records a resize so the node keeps its size when it reconnects
+func (m *Master) NodeResized(nh *NodeHandle, maxJobs int) {
+	m.nodeEvent(nh.NodeId, "resized", strconv.Itoa(maxJobs), func(rec *NodeRecord) {
+		rec.MaxJobs = maxJobs
+	})
+}
+
+// records a drain or undrain so it sticks to the node when it reconnects
+func (m *Master) NodeDrained(nh *NodeHandle) {
+	draining, shutdown := nh.Draining()
+	event := "undrained"
+	if draining {
+		event = "drained"
+	}
+	m.nodeEvent(nh.NodeId, event, "shutdown="+strconv.FormatBool(shutdown), func(rec *NodeRecord) {
+		rec.Draining = draining
+		rec.Shutdown = shutdown
+	})
+}
+
+// records that a drained node was told to shut down.  it stays drained, so it takes no tasks when it is
+// restarted until it is undrained.
+func (m *Master) NodeShutdown(nh *NodeHandle) {
+	m.nodeEvent(nh.NodeId, "shutdown", "", func(rec *NodeRecord) {
+		rec.Shutdown = false
+	})
+}
+
+// every node the master knows about, online or not
+func (m *Master) NodeRecords() []NodeRecord {
+	m.registryMu.Lock()
+	items := make(nodeRecords, 0, len(m.registry))
+	for _, rec := range m.registry {
+		items = append(items, *rec)
+	}
+	m.registryMu.Unlock()
+
+	sort.Sort(items)
+	return items
+}
+
+// the record of the node with the id, false if the master has never seen it
+func (m *Master) NodeRecord(nodeId string) (NodeRecord, bool) {
+	m.registryMu.Lock()
+	defer m.registryMu.Unlock()
+	if rec, isin := m.registry[nodeId]; isin {
+		return *rec, true
+	}
+	return NodeRecord{}, false
+}
+
+// GET /nodes/registry or GET /nodes/registry/id
+func (this MasterNodeController) findRegistry(rw http.ResponseWriter, parts []string) {
+	if len(parts) < 2 {
+		items := this.master.NodeRecords()
+		if err := json.NewEncoder(rw).Encode(NodeRecordList{Items: items, NumberOfItems: len(items)}); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	rec, isin := this.master.NodeRecord(parts[1])
+	if !isin {
+		http.Error(rw, "node "+parts[1]+" not known", http.StatusNotFound)
+		return
+	}
+	if err := json.NewEncoder(rw).Encode(rec); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	}
+}
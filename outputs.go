@@ -0,0 +1,342 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// bytes of an output file sent in each OUTPUT message
+const outputChunkSize = 64 * 1024
+
+// part of an output file on its way from a worker to the master, the body of an OUTPUT message
+type OutputChunk struct {
+	TaskId   int
+	Path     string // relative to the task's working directory
+	Size     int64  // of the whole file
+	Checksum string // sha256 of the whole file
+	Offset   int64
+	Data     []byte
+	Gzipped  bool // Data is gzipped, for masters that agreed to compressed-output
+	Attempt  int  // of the task that left the file, chunks of an earlier attempt are dropped
+}
+
+// an output file arriving on the master from one attempt of its task
+type outputTransfer struct {
+	attempt  int
+	chunks   map[int64]int // bytes written at each offset, a chunk sent again after a reconnect counts once
+	received int64
+	complete bool
+}
+
+// a file a task left behind, kept by the master under the job's output directory
+type OutputFile struct {
+	Path     string // task id, then the path relative to the task's working directory
+	Uri      string
+	Size     int64
+	Checksum string
+}
+
+type OutputFileList struct {
+	Items         []OutputFile
+	NumberOfItems int
+}
+
+// orders output files by path
+type outputFiles []OutputFile
+
+func (this outputFiles) Len() int           { return len(this) }
+func (this outputFiles) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+func (this outputFiles) Less(i, j int) bool { return this[i].Path < this[j].Path }
+
+// sends the files matching a task's output globs to the master in OUTPUT messages.  they go out before the
+// task's JOBFINISHED or JOBERROR, so the master has them by the time the task is done.
+func SendOutputs(con *Connection, job *WorkerJob, workDir string) {
+	if workDir == "" {
+		workDir = "."
+	}
+	for _, pattern := range job.Outputs {
+		matches, err := filepath.Glob(filepath.Join(workDir, pattern))
+		if err != nil {
+			logger.Warn(err)
+			continue
+		}
+		for _, match := range matches {
+			path, err := filepath.Rel(workDir, match)
+			if err != nil || strings.HasPrefix(path, "..") {
+				continue
+			}
+			if info, err := os.Stat(match); err != nil || info.IsDir() {
+				continue
+			}
+			if err := sendOutput(con, job, match, path); err != nil {
+				logger.Warn(err)
+				con.OutChan <- WorkerMessage{Type: CERROR, SubId: job.SubId, Body: fmt.Sprintf("Error sending output %s: %s\n", path, err)}
+			}
+		}
+	}
+}
+
+func sendOutput(con *Connection, job *WorkerJob, file string, path string) error {
+	checksum, size, err := fileChecksum(file)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	logger.Printf("sending output [%v, %d, %v, %d]", job.SubId, job.JobId, path, size)
+	var offset int64
+	for {
+		data := make([]byte, outputChunkSize)
+		n, err := io.ReadFull(f, data)
+		if n > 0 || offset == 0 {
+			chunk := OutputChunk{TaskId: job.JobId, Path: filepath.ToSlash(path), Size: size, Checksum: checksum,
+				Offset: offset, Data: data[:n], Attempt: job.Attempt}
+			if con.agreed.Has(CAP_COMPRESSED_OUTPUT) {
+				if chunk.Data, err = gzipBytes(data[:n]); err != nil {
+					return err
+				}
+				chunk.Gzipped = true
+			}
+			msg := WorkerMessage{Type: OUTPUT, SubId: job.SubId}
+			msg.BodyFromInterface(chunk)
+			con.OutChan <- msg
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// the sha256 and size of a file
+func fileChecksum(file string) (checksum string, size int64, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if size, err = io.Copy(hash, f); err != nil {
+		return
+	}
+	checksum = hex.EncodeToString(hash.Sum(nil))
+	return
+}
+
+// the directory the master keeps the job's output files in, one sub directory per task
+func (this *Submission) outputDir() string {
+	return this.jobId + ".files"
+}
+
+// the file under the output directory for path, false if path would lead outside it
+func (this *Submission) outputPath(path string) (string, bool) {
+	clean := filepath.Clean("/" + filepath.FromSlash(path))
+	if clean == string(filepath.Separator) {
+		return "", false
+	}
+	return filepath.Join(this.outputDir(), clean), true
+}
+
+// writes a chunk of an output file sent by a worker and checks the file once all of it has arrived.  chunks
+// can be handled out of order, so each is written at its offset.  the first chunk of a later attempt replaces what
+// an earlier attempt sent, and a file that arrives damaged is removed rather than listed.
+func (this *Submission) WriteOutput(chunk *OutputChunk) {
+	key := strconv.Itoa(chunk.TaskId) + "/" + chunk.Path
+	file, ok := this.outputPath(key)
+	if !ok {
+		logger.Printf("WriteOutput(): refusing output %v of %v", key, this.jobId)
+		return
+	}
+	if chunk.Gzipped {
+		data, err := gunzipBytes(chunk.Data)
+		if err != nil {
+			logger.Warn(err)
+			return
+		}
+		chunk.Data = data
+	}
+
+	this.outputMu.Lock()
+	defer this.outputMu.Unlock()
+
+	transfer, isin := this.transfers[key]
+	if isin && chunk.Attempt < transfer.attempt {
+		logger.Debug("WriteOutput(): dropping %v of %v from attempt %d", key, this.jobId, chunk.Attempt)
+		return
+	}
+	if !isin || chunk.Attempt > transfer.attempt {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			logger.Warn(err)
+			return
+		}
+		// a file from an earlier attempt is replaced
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			logger.Warn(err)
+		}
+		delete(this.outputs, key)
+		transfer = &outputTransfer{attempt: chunk.Attempt, chunks: map[int64]int{}}
+		this.transfers[key] = transfer
+	}
+	if _, seen := transfer.chunks[chunk.Offset]; seen || transfer.complete {
+		return
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	_, err = f.WriteAt(chunk.Data, chunk.Offset)
+	f.Close()
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+
+	transfer.chunks[chunk.Offset] = len(chunk.Data)
+	transfer.received += int64(len(chunk.Data))
+	if transfer.received < chunk.Size {
+		return
+	}
+	transfer.complete = true
+	transfer.chunks = nil
+
+	checksum, size, err := fileChecksum(file)
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	if checksum != chunk.Checksum || size != chunk.Size {
+		logger.Printf("WriteOutput(): %v of %v arrived damaged [%v, %d], removing it", key, this.jobId, checksum, size)
+		if err := os.Remove(file); err != nil {
+			logger.Warn(err)
+		}
+		return
+	}
+	this.outputs[key] = OutputFile{Path: key, Uri: "/jobs/" + this.jobId + "/files/" + key, Size: size, Checksum: checksum}
+}
+
+// the job's output files that have arrived in full, including those kept from before a master restart
+func (this *Submission) OutputFiles() []OutputFile {
+	this.outputMu.Lock()
+	defer this.outputMu.Unlock()
+
+	items := make(outputFiles, 0, len(this.outputs))
+	filepath.Walk(this.outputDir(), func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(this.outputDir(), file)
+		if err != nil {
+			return nil
+		}
+		key := filepath.ToSlash(rel)
+		if transfer, isin := this.transfers[key]; isin && !transfer.complete {
+			return nil
+		}
+
+		item, isin := this.outputs[key]
+		if !isin || item.Size != info.Size() {
+			checksum, size, err := fileChecksum(file)
+			if err != nil {
+				logger.Warn(err)
+				return nil
+			}
+			item = OutputFile{Path: key, Uri: "/jobs/" + this.jobId + "/files/" + key, Size: size, Checksum: checksum}
+			this.outputs[key] = item
+		}
+		items = append(items, item)
+		return nil
+	})
+	sort.Sort(items)
+	return items
+}
+
+// GET /jobs/id/files or GET /jobs/id/files/task-id/path
+func (this MasterJobController) findFiles(rw http.ResponseWriter, s *Submission, path []string) {
+	logger.Debug("findFiles(%v)", path)
+	if len(path) == 0 {
+		items := s.OutputFiles()
+		if err := json.NewEncoder(rw).Encode(OutputFileList{Items: items, NumberOfItems: len(items)}); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	file, ok := s.outputPath(strings.Join(path, "/"))
+	if !ok {
+		http.Error(rw, "GET /jobs/id/files/task-id/path", http.StatusBadRequest)
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		http.Error(rw, "file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(rw, f); err != nil {
+		logger.Warn(err)
+	}
+}
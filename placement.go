@@ -0,0 +1,111 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"strings"
+)
+
+// splits a comma separated list of labels such as "genome=hg38,matlab", dropping empty entries
+func ParseLabels(value string) (labels []string) {
+	for _, label := range strings.Split(value, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return
+}
+
+// a "key=value" label matches only itself, a bare "key" matches any label with that key
+func labelMatches(label string, want string) bool {
+	if label == want {
+		return true
+	}
+	return !strings.Contains(want, "=") && strings.HasPrefix(label, want+"=")
+}
+
+// the number of wanted labels found in labels
+func matchingLabels(labels []string, wanted []string) (count int) {
+	for _, want := range wanted {
+		for _, label := range labels {
+			if labelMatches(label, want) {
+				count++
+				break
+			}
+		}
+	}
+	return
+}
+
+// true if the node has every label in constraints
+func (nh *NodeHandle) Satisfies(constraints []string) bool {
+	return matchingLabels(nh.Labels, constraints) == len(constraints)
+}
+
+// true if the node could run a task of the given line once it is idle
+func (nh *NodeHandle) CanRun(constraints []string, task Task) bool {
+	if !nh.Satisfies(constraints) || !nh.Capable(task.Inputs, task.Outputs) {
+		return false
+	}
+	processes, _ := nh.Stats()
+	wj := WorkerJob{Cpus: task.Cpus, Memory: task.Memory}
+	if wj.Slots() > processes {
+		return false
+	}
+	return nh.Memory == 0 || wj.Memory <= nh.Memory
+}
+
+// marks submissions with a task line that no connected node could run as unschedulable, and clears the mark
+// once such a node connects.  called whenever a job is submitted or a node comes or goes.
+func (m *Master) CheckSchedulable() {
+	m.nodeMu.RLock()
+	handles := make([]*NodeHandle, 0, len(m.NodeHandles))
+	for _, nh := range m.NodeHandles {
+		handles = append(handles, nh)
+	}
+	m.nodeMu.RUnlock()
+
+	m.subMu.RLock()
+	subs := make([]*Submission, 0, len(m.subMap))
+	for _, s := range m.subMap {
+		if s != nil {
+			subs = append(subs, s)
+		}
+	}
+	m.subMu.RUnlock()
+
+	for _, s := range subs {
+		unschedulable := false
+		for _, task := range s.Tasks {
+			runnable := false
+			for _, nh := range handles {
+				if nh.CanRun(s.constraints, task) {
+					runnable = true
+					break
+				}
+			}
+			if !runnable {
+				unschedulable = true
+				break
+			}
+		}
+		s.SetUnschedulable(unschedulable)
+	}
+}
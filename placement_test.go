@@ -0,0 +1,90 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", nil},
+		{"matlab", []string{"matlab"}},
+		{"genome=hg38, matlab ,,", []string{"genome=hg38", "matlab"}},
+		{" , ", nil},
+	}
+	for _, test := range tests {
+		if got := ParseLabels(test.value); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseLabels(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestMatchingLabels(t *testing.T) {
+	labels := []string{"genome=hg38", "matlab", "gpu=k80"}
+	tests := []struct {
+		wanted []string
+		want   int
+	}{
+		{nil, 0},
+		{[]string{"matlab"}, 1},
+		{[]string{"genome"}, 1},
+		{[]string{"genome=hg38"}, 1},
+		{[]string{"genome=hg19"}, 0},
+		{[]string{"matlab=2014"}, 0},
+		{[]string{"gen"}, 0},
+		{[]string{"genome", "gpu", "matlab", "R"}, 3},
+	}
+	for _, test := range tests {
+		if got := matchingLabels(labels, test.wanted); got != test.want {
+			t.Errorf("matchingLabels(%v, %v) = %d, want %d", labels, test.wanted, got, test.want)
+		}
+	}
+}
+
+func TestNodeHandleCanRun(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      []string
+		constraints []string
+		task        Task
+		want        bool
+	}{
+		{"no constraints", nil, nil, Task{}, true},
+		{"satisfied", []string{"genome=hg38", "matlab"}, []string{"genome", "matlab"}, Task{}, true},
+		{"missing label", []string{"genome=hg38"}, []string{"genome", "matlab"}, Task{}, false},
+		{"wrong value", []string{"genome=hg38"}, []string{"genome=hg19"}, Task{}, false},
+		{"busy but big enough", nil, nil, Task{Cpus: 4, Memory: 8192}, true},
+		{"too many cpus", nil, nil, Task{Cpus: 5}, false},
+		{"too much memory", nil, nil, Task{Memory: 9000}, false},
+		{"inputs without staging", nil, nil, Task{Inputs: []TaskInput{{Name: "in", Blob: "abc"}}}, false},
+	}
+	for _, test := range tests {
+		nh := testNode(4, 4, 8192, 8192)
+		nh.Labels = test.labels
+		if got := nh.CanRun(test.constraints, test.task); got != test.want {
+			t.Errorf("%v: CanRun(%v) on %v = %v, want %v", test.name, test.constraints, test.labels, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// version of the messages workers and the master exchange.  1 is what workers spoke before they said which
+// version they speak, 2 adds numbered messages and the WELCOME answer to HELLO
+const protocolVersion = 2
+
+// things a worker or master may or may not be able to do, agreed on when a worker says hello
+const (
+	CAP_DELIVERY          = "delivery"          // numbers, acknowledges and replays messages
+	CAP_STAGING           = "staging"           // fetches task inputs from the master's blob store
+	CAP_OUTPUTS           = "outputs"           // sends task output files back to the master
+	CAP_COMPRESSED_OUTPUT = "compressed-output" // gzips output file chunks on the way
+)
+
+// what this build can do, on either end
+var capabilities = []string{CAP_DELIVERY, CAP_STAGING, CAP_OUTPUTS, CAP_COMPRESSED_OUTPUT}
+
+// the master's answer to a worker's HELLO, the body of a WELCOME message
+type Welcome struct {
+	Protocol     int        // the version both ends speak, the lower of the two
+	Capabilities []string   // what both ends can do
+	Delivery     *Handshake // nil if the worker doesn't number its messages
+}
+
+// the capabilities a worker agreed with its master, set once the master's WELCOME arrives
+type CapabilitySet struct {
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+func NewCapabilitySet(names []string) *CapabilitySet {
+	set := &CapabilitySet{}
+	set.Set(names)
+	return set
+}
+
+func (this *CapabilitySet) Set(names []string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.names = map[string]bool{}
+	for _, name := range names {
+		this.names[name] = true
+	}
+}
+
+func (this *CapabilitySet) Has(name string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.names[name]
+}
+
+// the protocol version and capabilities to use with a worker, or why the master won't work with it.  workers
+// that speak a newer version are spoken to in this master's, and only the capabilities both ends have are used.
+func Negotiate(hello *HelloMsgBody) (protocol int, agreed []string, err error) {
+	protocol = hello.Protocol
+	if protocol == 0 {
+		protocol = 1
+	}
+	if protocol < minProtocolVersion {
+		err = fmt.Errorf("worker speaks protocol version %d, this master (version %v) needs at least %d",
+			protocol, golemVersion, minProtocolVersion)
+		return
+	}
+	if protocol > protocolVersion {
+		protocol = protocolVersion
+	}
+
+	ours := map[string]bool{}
+	for _, name := range capabilities {
+		ours[name] = true
+	}
+	agreed = make([]string, 0)
+	for _, name := range hello.Capabilities {
+		if ours[name] {
+			agreed = append(agreed, name)
+		}
+	}
+	sort.Strings(agreed)
+	return
+}
+
+func hasCapability(names []string, capability string) bool {
+	for _, name := range names {
+		if name == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// true if the node agreed to the capability when it said hello
+func (nh *NodeHandle) Can(capability string) bool {
+	return hasCapability(nh.Capabilities, capability)
+}
+
+// false if the task needs something the node can't do
+func (nh *NodeHandle) Capable(inputs []TaskInput, outputs []string) bool {
+	if len(inputs) > 0 && !nh.Can(CAP_STAGING) {
+		return false
+	}
+	return len(outputs) == 0 || nh.Can(CAP_OUTPUTS)
+}
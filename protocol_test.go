@@ -0,0 +1,82 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	defer func(min int) { minProtocolVersion = min }(minProtocolVersion)
+
+	tests := []struct {
+		minProtocol  int
+		protocol     int
+		capabilities []string
+		want         int
+		agreed       []string
+		refused      bool
+	}{
+		{1, 0, nil, 1, []string{}, false},
+		{1, 1, nil, 1, []string{}, false},
+		{1, 2, []string{CAP_OUTPUTS, CAP_DELIVERY}, 2, []string{CAP_DELIVERY, CAP_OUTPUTS}, false},
+		{1, 3, []string{"teleport", CAP_STAGING}, protocolVersion, []string{CAP_STAGING}, false},
+		{2, 0, nil, 0, nil, true},
+		{2, 1, []string{CAP_DELIVERY}, 0, nil, true},
+		{2, 2, capabilities, 2, []string{CAP_COMPRESSED_OUTPUT, CAP_DELIVERY, CAP_OUTPUTS, CAP_STAGING}, false},
+	}
+	for _, test := range tests {
+		minProtocolVersion = test.minProtocol
+		hello := &HelloMsgBody{Protocol: test.protocol, Capabilities: test.capabilities}
+		protocol, agreed, err := Negotiate(hello)
+		if (err != nil) != test.refused {
+			t.Errorf("min %d Negotiate(%d, %v) error = %v, want refused %v", test.minProtocol, test.protocol, test.capabilities, err, test.refused)
+			continue
+		}
+		if test.refused {
+			continue
+		}
+		if protocol != test.want || !reflect.DeepEqual(agreed, test.agreed) {
+			t.Errorf("min %d Negotiate(%d, %v) = %d, %v, want %d, %v", test.minProtocol, test.protocol, test.capabilities,
+				protocol, agreed, test.want, test.agreed)
+		}
+	}
+}
+
+func TestCapabilitySet(t *testing.T) {
+	set := NewCapabilitySet(nil)
+	tests := []struct {
+		names []string
+		has   map[string]bool
+	}{
+		{nil, map[string]bool{CAP_DELIVERY: false}},
+		{[]string{CAP_DELIVERY, CAP_OUTPUTS}, map[string]bool{CAP_DELIVERY: true, CAP_OUTPUTS: true, CAP_STAGING: false}},
+		{[]string{CAP_STAGING}, map[string]bool{CAP_DELIVERY: false, CAP_STAGING: true}},
+	}
+	for _, test := range tests {
+		set.Set(test.names)
+		for name, want := range test.has {
+			if got := set.Has(name); got != want {
+				t.Errorf("Set(%v) Has(%v) = %v, want %v", test.names, name, got, want)
+			}
+		}
+	}
+}
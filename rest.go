@@ -21,7 +21,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 func GetHeader(r *http.Request, headerName string, defaultValue string) string {
@@ -33,6 +36,89 @@ func GetHeader(r *http.Request, headerName string, defaultValue string) string {
 	return defaultValue
 }
 
+// like GetHeader but parses the value as an integer, returns an error if the header is present but not a number
+func GetIntHeader(r *http.Request, headerName string, defaultValue int) (int, error) {
+	val := GetHeader(r, headerName, "")
+	if val == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(val)
+}
+
+// reads the retry policy headers of a job submission, absent headers are left unset
+func GetRetryPolicy(r *http.Request) (policy RetryPolicy, err error) {
+	if policy.MaxAttempts, err = GetIntHeader(r, "x-golem-job-max-attempts", 0); err != nil {
+		return
+	}
+	if policy.Backoff, err = GetIntHeader(r, "x-golem-job-retry-backoff", -1); err != nil {
+		return
+	}
+	if policy.Backoff < -1 {
+		err = errors.New("x-golem-job-retry-backoff must not be negative")
+		return
+	}
+	if elsewhere := GetHeader(r, "x-golem-job-retry-elsewhere", ""); elsewhere != "" {
+		var avoid bool
+		if avoid, err = strconv.ParseBool(elsewhere); err == nil {
+			policy.AvoidFailedNode = &avoid
+		}
+	}
+	return
+}
+
+// reads the task and job timeout headers of a job submission, in seconds
+func GetTimeouts(r *http.Request) (taskTimeout int, jobTimeout int, err error) {
+	if taskTimeout, err = GetIntHeader(r, "x-golem-task-timeout", 0); err != nil {
+		return
+	}
+	if taskTimeout < 0 {
+		err = errors.New("x-golem-task-timeout: must not be negative")
+		return
+	}
+	if jobTimeout, err = GetIntHeader(r, "x-golem-job-timeout", 0); err == nil && jobTimeout < 0 {
+		err = errors.New("x-golem-job-timeout: must not be negative")
+	}
+	return
+}
+
+// reads the comma separated prerequisite job ids and their condition from a job submission
+func GetPrerequisites(r *http.Request, jobId string) (prerequisites []string, condition string, err error) {
+	for _, prereq := range strings.Split(GetHeader(r, "x-golem-job-after", ""), ",") {
+		prereq = strings.TrimSpace(prereq)
+		if prereq == "" {
+			continue
+		}
+		if prereq == jobId {
+			err = errors.New("x-golem-job-after: job can't depend on itself")
+			return
+		}
+		prerequisites = append(prerequisites, prereq)
+	}
+
+	condition = GetHeader(r, "x-golem-job-after-condition", AFTER_SUCCESS)
+	switch condition {
+	case AFTER_SUCCESS, AFTER_COMPLETION, AFTER_FAILURE:
+	default:
+		err = errors.New("x-golem-job-after-condition: must be success, complete or failure")
+	}
+	return
+}
+
+// reads the limit on how many of a job's tasks may run at once, 0 for no limit
+func GetMaxConcurrent(r *http.Request) (maxConcurrent int, err error) {
+	if maxConcurrent, err = GetIntHeader(r, "x-golem-job-max-concurrent", 0); err == nil && maxConcurrent < 0 {
+		err = errors.New("must not be negative")
+	}
+	return
+}
+
+// reads the comma separated node labels a job requires and prefers
+func GetPlacement(r *http.Request) (constraints []string, preferences []string) {
+	constraints = ParseLabels(GetHeader(r, "x-golem-job-constraint", ""))
+	preferences = ParseLabels(GetHeader(r, "x-golem-job-prefer", ""))
+	return
+}
+
 func LoadTasksFromJson(r *http.Request, tasks *[]Task) (err error) {
 	logger.Debug("LoadTasksFromJson(%v)", r.URL.Path)
 
@@ -47,6 +133,7 @@ func LoadTasksFromJson(r *http.Request, tasks *[]Task) (err error) {
 		logger.Warn(err)
 		return
 	}
+	r.MultipartForm = frm
 
 	jsonfile, err := frm.File["jsonfile"][0].Open()
 	if err != nil {
@@ -58,7 +145,10 @@ func LoadTasksFromJson(r *http.Request, tasks *[]Task) (err error) {
 	err = json.NewDecoder(jsonfile).Decode(&tasks)
 	if err != nil {
 		logger.Warn(err)
+		return
 	}
+
+	err = PrepareSweeps(frm, *tasks)
 	return
 }
 
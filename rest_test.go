@@ -0,0 +1,52 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGetTimeouts(t *testing.T) {
+	tests := []struct {
+		task    string
+		job     string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"60", "3600", false},
+		{"0", "0", false},
+		{"-1", "", true},
+		{"", "-1", true},
+		{"soon", "", true},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("POST", "/jobs/", nil)
+		if test.task != "" {
+			r.Header.Set("x-golem-task-timeout", test.task)
+		}
+		if test.job != "" {
+			r.Header.Set("x-golem-job-timeout", test.job)
+		}
+		if _, _, err := GetTimeouts(r); (err != nil) != test.wantErr {
+			t.Errorf("GetTimeouts(task %q, job %q) error = %v, want error %v", test.task, test.job, err, test.wantErr)
+		}
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -160,6 +161,37 @@ func (this *Scribe) PostJob(jd JobDetails) (err error) {
 	if jd.Type != "" {
 		r.Header.Set("x-golem-job-type", jd.Type)
 	}
+	if jd.Priority != 0 {
+		r.Header.Set("x-golem-job-priority", fmt.Sprintf("%d", jd.Priority))
+	}
+	if jd.MaxConcurrent > 0 {
+		r.Header.Set("x-golem-job-max-concurrent", fmt.Sprintf("%d", jd.MaxConcurrent))
+	}
+	if jd.Retry.MaxAttempts > 0 {
+		r.Header.Set("x-golem-job-max-attempts", fmt.Sprintf("%d", jd.Retry.MaxAttempts))
+	}
+	if jd.Retry.Backoff >= 0 {
+		r.Header.Set("x-golem-job-retry-backoff", fmt.Sprintf("%d", jd.Retry.Backoff))
+	}
+	if jd.Retry.AvoidFailedNode != nil {
+		r.Header.Set("x-golem-job-retry-elsewhere", strconv.FormatBool(*jd.Retry.AvoidFailedNode))
+	}
+	if jd.TaskTimeout > 0 {
+		r.Header.Set("x-golem-task-timeout", fmt.Sprintf("%d", jd.TaskTimeout))
+	}
+	if jd.JobTimeout > 0 {
+		r.Header.Set("x-golem-job-timeout", fmt.Sprintf("%d", jd.JobTimeout))
+	}
+	if len(jd.Prerequisites) > 0 {
+		r.Header.Set("x-golem-job-after", strings.Join(jd.Prerequisites, ","))
+		r.Header.Set("x-golem-job-after-condition", jd.Condition)
+	}
+	if len(jd.Constraints) > 0 {
+		r.Header.Set("x-golem-job-constraint", strings.Join(jd.Constraints, ","))
+	}
+	if len(jd.Preferences) > 0 {
+		r.Header.Set("x-golem-job-prefer", strings.Join(jd.Preferences, ","))
+	}
 
 	go func() {
 		logger.Debug("encoding tasks")
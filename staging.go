@@ -0,0 +1,189 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// blobs are checked against their checksum once fetched, so the master's self signed certificate isn't verified
+var blobClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+// fetches a task's inputs from master into a new directory for the task under stageDir and returns the directory
+func StageTaskInputs(master string, job *WorkerJob) (dir string, err error) {
+	dir = filepath.Join(stageDir, "tasks", fmt.Sprintf("%v-%d-%d", job.SubId, job.JobId, job.Attempt))
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	for _, input := range job.Inputs {
+		var cached string
+		if cached, err = CachedBlob(master, input.Blob); err != nil {
+			return
+		}
+		if input.Unpack {
+			err = unpack(cached, dir)
+		} else {
+			err = copyFile(cached, filepath.Join(dir, filepath.Clean("/"+input.Name)))
+		}
+		if err != nil {
+			err = fmt.Errorf("input %v: %v", input.Name, err)
+			return
+		}
+	}
+	return
+}
+
+// the path of a blob in the worker's cache, fetching it from the master if it isn't there yet
+func CachedBlob(master string, checksum string) (string, error) {
+	cacheDir := filepath.Join(stageDir, "cache")
+	path := filepath.Join(cacheDir, filepath.Base(checksum))
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", err
+	}
+
+	prot := "http"
+	if useTls {
+		prot = "https"
+	}
+	url := fmt.Sprintf("%v://%v/blobs/%v", prot, master, checksum)
+	logger.Printf("fetching %v", url)
+	resp, err := blobClient.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching blob %v: %v", checksum, resp.Status)
+	}
+
+	tmp, err := os.OpenFile(filepath.Join(cacheDir, "fetch-"+UniqueId()), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0755)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	tmp.Close()
+	if err == nil && hex.EncodeToString(hash.Sum(nil)) != checksum {
+		err = fmt.Errorf("blob %v arrived with checksum %v", checksum, hex.EncodeToString(hash.Sum(nil)))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	// tasks fetching the same blob at once each rename a complete copy into place
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// copies a cached blob into a task directory, tasks get their own copy so they can't change the cache
+func copyFile(from string, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// unpacks a tar file, gzipped or not, into dir.  entries that would land outside dir are refused.
+func unpack(archive string, dir string) error {
+	dir = filepath.Clean(dir)
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if gz, err := gzip.NewReader(file); err == nil {
+		defer gz.Close()
+		r = gz
+	} else if _, err = file.Seek(0, 0); err != nil {
+		return err
+	}
+
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, header.Name)
+		if target != dir && !strings.HasPrefix(target, dir+string(filepath.Separator)) {
+			return fmt.Errorf("%v is outside the task directory", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, os.FileMode(header.Mode)|0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeEntry(reader, target, os.FileMode(header.Mode))
+		default:
+			logger.Printf("unpack(%v): skipping %v", archive, header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeEntry(r io.Reader, target string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
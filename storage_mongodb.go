@@ -71,18 +71,31 @@ func (this *MongoJobStore) Unscheduled() ([]JobDetails, error) {
 func (this *MongoJobStore) CountPending() (pending int, err error) {
 	var newOnes int
 	var scheduledOnes int
+	var waitingOnes int
 	if newOnes, err = this.CountJobs(bson.M{"state": NEW}); err != nil {
 		return
 	}
 	if scheduledOnes, err = this.CountJobs(bson.M{"state": SCHEDULED}); err != nil {
 		return
 	}
-	pending = newOnes + scheduledOnes
+	if waitingOnes, err = this.CountJobs(bson.M{"state": WAITING}); err != nil {
+		return
+	}
+	pending = newOnes + scheduledOnes + waitingOnes
 	return
 }
 
-func (this *MongoJobStore) CountActive() (int, error) {
-	return this.CountJobs(bson.M{"state": RUNNING})
+func (this *MongoJobStore) CountActive() (active int, err error) {
+	var runningOnes int
+	var pausedOnes int
+	if runningOnes, err = this.CountJobs(bson.M{"state": RUNNING}); err != nil {
+		return
+	}
+	if pausedOnes, err = this.CountJobs(bson.M{"state": PAUSED}); err != nil {
+		return
+	}
+	active = runningOnes + pausedOnes
+	return
 }
 
 func (this *MongoJobStore) Get(jobId string) (item JobDetails, err error) {
@@ -123,8 +136,17 @@ func (this *MongoJobStore) Update(item JobDetails) (err error) {
 	existing.LastModified = time.Now().String()
 	existing.Progress.Finished = item.Progress.Finished
 	existing.Progress.Errored = item.Progress.Errored
+	existing.Progress.Retried = item.Progress.Retried
+	existing.Progress.TimedOut = item.Progress.TimedOut
+	existing.Usage = item.Usage
+	existing.Retry = item.Retry
 	existing.State = item.State
 	existing.Status = item.Status
+	existing.Priority = item.Priority
+	existing.MaxConcurrent = item.MaxConcurrent
+	existing.WaitingOn = item.WaitingOn
+	existing.Unschedulable = item.Unschedulable
+	existing.Unplaced = item.Unplaced
 
 	return jobsCollection.Update(bson.M{"jobid": item.JobId}, existing)
 }
@@ -0,0 +1,252 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"strconv"
+	"strings"
+)
+
+// turns a task's Args into a template, run once for every combination of parameter values (or every nth
+// value of each parameter when Zip is set).  ${name} in the Args is replaced by the value of parameter name
+// and ${i} by the number of the task within its line.
+type Sweep struct {
+	Params []SweepParam
+	Zip    bool
+}
+
+// one placeholder of a sweep and its values, given as a list, as a range of numbers from From to To
+// (inclusive) by Step, or as the name of a file sent along with the job that has one value per line
+type SweepParam struct {
+	Name   string
+	Values []string
+	From   int
+	To     int
+	Step   int
+	File   string
+}
+
+// most tasks one sweep task line may expand into
+const maxSweepTasks = 1 << 24
+
+// what GET /jobs/id shows of a sweep task line
+type SweepSummary struct {
+	Args   []string // the argument template
+	Params []string // each parameter with its number of values, e.g. sample(12)
+	Zip    bool
+	Total  int // tasks the line expands into
+}
+
+func (this SweepParam) step() int {
+	if this.Step == 0 {
+		return 1
+	}
+	return this.Step
+}
+
+// the number of values of the parameter, 0 for a range that steps away from To
+func (this SweepParam) Len() int {
+	if this.Values != nil {
+		return len(this.Values)
+	}
+	span := this.To - this.From
+	if span != 0 && (span < 0) != (this.step() < 0) {
+		return 0
+	}
+	return span/this.step() + 1
+}
+
+// the nth value of the parameter
+func (this SweepParam) Value(n int) string {
+	if this.Values != nil {
+		return this.Values[n]
+	}
+	return strconv.Itoa(this.From + n*this.step())
+}
+
+// the number of combinations of parameter values the sweep runs, stops counting past maxSweepTasks
+func (this *Sweep) Combinations() int {
+	if len(this.Params) == 0 {
+		return 0
+	}
+	if this.Zip {
+		return this.Params[0].Len()
+	}
+	combinations := 1
+	for _, param := range this.Params {
+		n := param.Len()
+		if n == 0 {
+			return 0
+		}
+		if combinations > maxSweepTasks/n {
+			return maxSweepTasks + 1
+		}
+		combinations *= n
+	}
+	return combinations
+}
+
+// the parameter values of the nth combination, the last parameter changes fastest
+func (this *Sweep) valuesFor(n int) map[string]string {
+	values := map[string]string{}
+	if this.Zip {
+		for _, param := range this.Params {
+			values[param.Name] = param.Value(n)
+		}
+		return values
+	}
+	for i := len(this.Params) - 1; i >= 0; i-- {
+		param := this.Params[i]
+		values[param.Name] = param.Value(n % param.Len())
+		n = n / param.Len()
+	}
+	return values
+}
+
+// checks the sweep can be expanded, files must have been read into Values already
+func (this *Sweep) Validate() error {
+	if len(this.Params) == 0 {
+		return errors.New("sweep has no parameters")
+	}
+	for _, param := range this.Params {
+		switch {
+		case param.Name == "" || param.Name == "i":
+			return errors.New("sweep parameters need a name other than i")
+		case param.File != "":
+			return fmt.Errorf("sweep parameter %v: file %v was not read", param.Name, param.File)
+		case param.Len() == 0:
+			return fmt.Errorf("sweep parameter %v has no values", param.Name)
+		case this.Zip && param.Len() != this.Params[0].Len():
+			return fmt.Errorf("zipped sweep parameter %v has %d values, %v has %d", param.Name, param.Len(), this.Params[0].Name, this.Params[0].Len())
+		}
+	}
+	return nil
+}
+
+// the number of tasks the line expands into, Count times every combination for a sweep
+func (this Task) Size() int {
+	if this.Sweep == nil {
+		return this.Count
+	}
+	return this.repeats() * this.Sweep.Combinations()
+}
+
+func (this Task) repeats() int {
+	if this.Count < 1 {
+		return 1
+	}
+	return this.Count
+}
+
+// the arguments of the nth task of the line, with the placeholders of a sweep filled in
+func (this Task) ArgsFor(n int) []string {
+	if this.Sweep == nil {
+		return this.Args
+	}
+
+	values := this.Sweep.valuesFor(n / this.repeats())
+	values["i"] = strconv.Itoa(n)
+
+	// one pass, so a value that itself looks like ${name} is left as it is
+	pairs := make([]string, 0, 2*len(values))
+	for name, value := range values {
+		pairs = append(pairs, "${"+name+"}", value)
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	args := make([]string, len(this.Args))
+	for k, arg := range this.Args {
+		args[k] = replacer.Replace(arg)
+	}
+	return args
+}
+
+// reads the values of sweep parameters given as files from the rest of the submitted form and checks every sweep
+func PrepareSweeps(frm *multipart.Form, tasks []Task) error {
+	for _, task := range tasks {
+		if task.Sweep == nil {
+			continue
+		}
+		for p := range task.Sweep.Params {
+			param := &task.Sweep.Params[p]
+			if param.File == "" {
+				continue
+			}
+			values, err := readValues(frm, param.File)
+			if err != nil {
+				return fmt.Errorf("sweep parameter %v: %v", param.Name, err)
+			}
+			param.Values = values
+			param.File = ""
+		}
+		if err := task.Sweep.Validate(); err != nil {
+			return err
+		}
+		if task.Sweep.Combinations() > maxSweepTasks/task.repeats() {
+			return fmt.Errorf("sweep expands into more than %d tasks", maxSweepTasks)
+		}
+	}
+	return nil
+}
+
+// the non-blank lines of a file in the form
+func readValues(frm *multipart.Form, name string) (values []string, err error) {
+	files := frm.File[name]
+	if len(files) == 0 {
+		return nil, fmt.Errorf("file %v not sent", name)
+	}
+	file, err := files[0].Open()
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	values = make([]string, 0)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			values = append(values, line)
+		}
+		if err != nil {
+			break
+		}
+	}
+	return values, nil
+}
+
+// summaries of the sweep task lines of a job
+func SweepSummaries(tasks []Task) (summaries []SweepSummary) {
+	for _, task := range tasks {
+		if task.Sweep == nil {
+			continue
+		}
+		params := make([]string, len(task.Sweep.Params))
+		for i, param := range task.Sweep.Params {
+			params[i] = fmt.Sprintf("%v(%d)", param.Name, param.Len())
+		}
+		summaries = append(summaries, SweepSummary{Args: task.Args, Params: params, Zip: task.Sweep.Zip, Total: task.Size()})
+	}
+	return
+}
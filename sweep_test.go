@@ -0,0 +1,92 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSweepParamLen(t *testing.T) {
+	tests := []struct {
+		param SweepParam
+		want  int
+	}{
+		{SweepParam{Values: []string{"a", "b", "c"}}, 3},
+		{SweepParam{Values: []string{}}, 0},
+		{SweepParam{From: 1, To: 10}, 10},
+		{SweepParam{From: 1, To: 10, Step: 3}, 4},
+		{SweepParam{From: 5, To: 5}, 1},
+		{SweepParam{From: 5, To: 5, Step: -1}, 1},
+		{SweepParam{From: 10, To: 1, Step: -3}, 4},
+		{SweepParam{From: 0, To: -5}, 0},
+		{SweepParam{From: 0, To: -1, Step: 2}, 0},
+		{SweepParam{From: 0, To: 1, Step: -2}, 0},
+		{SweepParam{From: 10, To: 1, Step: 3}, 0},
+	}
+	for _, test := range tests {
+		if got := test.param.Len(); got != test.want {
+			t.Errorf("%+v Len() = %d, want %d", test.param, got, test.want)
+		}
+	}
+}
+
+func TestSweepCombinations(t *testing.T) {
+	big := SweepParam{From: 1, To: 1 << 20}
+	tests := []struct {
+		sweep Sweep
+		want  int
+	}{
+		{Sweep{}, 0},
+		{Sweep{Params: []SweepParam{{From: 1, To: 3}}}, 3},
+		{Sweep{Params: []SweepParam{{From: 1, To: 3}, {Values: []string{"a", "b"}}}}, 6},
+		{Sweep{Params: []SweepParam{{From: 1, To: 3}, {Values: []string{"a", "b", "c"}}}, Zip: true}, 3},
+		{Sweep{Params: []SweepParam{{From: 1, To: 3}, {From: 0, To: -1, Step: 2}}}, 0},
+		{Sweep{Params: []SweepParam{big, big, big, big}}, maxSweepTasks + 1},
+	}
+	for _, test := range tests {
+		if got := test.sweep.Combinations(); got != test.want {
+			t.Errorf("%+v Combinations() = %d, want %d", test.sweep, got, test.want)
+		}
+	}
+}
+
+func TestTaskArgsFor(t *testing.T) {
+	task := Task{Args: []string{"run", "${sample}-${n}", "${i}", "${other}"},
+		Sweep: &Sweep{Params: []SweepParam{{Name: "sample", Values: []string{"x", "${n}"}}, {Name: "n", From: 1, To: 2}}}}
+	repeated := task
+	repeated.Count = 2
+	tests := []struct {
+		task Task
+		n    int
+		want []string
+	}{
+		{task, 0, []string{"run", "x-1", "0", "${other}"}},
+		{task, 1, []string{"run", "x-2", "1", "${other}"}},
+		{task, 2, []string{"run", "${n}-1", "2", "${other}"}},
+		{repeated, 3, []string{"run", "x-2", "3", "${other}"}},
+		{Task{Args: []string{"${i}"}}, 5, []string{"${i}"}},
+	}
+	for _, test := range tests {
+		if got := test.task.ArgsFor(test.n); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v ArgsFor(%d) = %q, want %q", test.task.Args, test.n, got, test.want)
+		}
+	}
+}
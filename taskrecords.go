@@ -0,0 +1,112 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// orders task records by task id
+type taskRecords []TaskRecord
+
+func (this taskRecords) Len() int           { return len(this) }
+func (this taskRecords) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+func (this taskRecords) Less(i, j int) bool { return this[i].TaskId < this[j].TaskId }
+
+// records that a task was sent to a node
+func (this *Submission) TaskStarted(wj *WorkerJob, nodeId string, host string) {
+	this.recordMu.Lock()
+	defer this.recordMu.Unlock()
+	this.records[wj.JobId] = &TaskRecord{SubId: wj.SubId, TaskId: wj.JobId, LineId: wj.LineId, Args: wj.Args,
+		State: TASK_RUNNING, NodeId: nodeId, Host: host, Attempt: wj.Attempt, Started: time.Now().String()}
+}
+
+// records that a task finished, errored or was lost with its node and is queued to run again
+func (this *Submission) TaskStopped(wj *WorkerJob, state string) {
+	this.recordMu.Lock()
+	defer this.recordMu.Unlock()
+	rec, isin := this.records[wj.JobId]
+	if !isin {
+		rec = &TaskRecord{SubId: wj.SubId, TaskId: wj.JobId, LineId: wj.LineId, Args: wj.Args, Attempt: wj.Attempt}
+		this.records[wj.JobId] = rec
+	}
+	rec.State = state
+	rec.Ended = time.Now().String()
+	if state != TASK_FINISHED {
+		rec.Error = wj.Error
+	}
+	rec.Result = wj.Result
+}
+
+// records the signal a worker terminated a task with after being told to kill it
+func (this *Submission) TaskKilled(taskId int, signal string) {
+	this.recordMu.Lock()
+	defer this.recordMu.Unlock()
+	if rec, isin := this.records[taskId]; isin {
+		rec.Killed = signal
+	}
+}
+
+// the record of task taskId, false if the task hasn't been sent to a node yet
+func (this *Submission) TaskRecord(taskId int) (TaskRecord, bool) {
+	this.recordMu.Lock()
+	defer this.recordMu.Unlock()
+	if rec, isin := this.records[taskId]; isin {
+		return *rec, true
+	}
+	return TaskRecord{}, false
+}
+
+// the records of the job's tasks that have been sent to a node and match keep, by task id
+func (this *Submission) TaskRecords(keep func(TaskRecord) bool) []TaskRecord {
+	this.recordMu.Lock()
+	items := make(taskRecords, 0, len(this.records))
+	for _, rec := range this.records {
+		if keep(*rec) {
+			items = append(items, *rec)
+		}
+	}
+	this.recordMu.Unlock()
+
+	sort.Sort(items)
+	return items
+}
+
+// the records of the tasks running on a node right now
+func (m *Master) NodeTaskRecords(nh *NodeHandle) []TaskRecord {
+	nh.assignMu.Lock()
+	jobs := make([]*WorkerJob, 0, len(nh.assigned))
+	for _, wj := range nh.assigned {
+		jobs = append(jobs, wj)
+	}
+	nh.assignMu.Unlock()
+
+	items := make(taskRecords, 0, len(jobs))
+	for _, wj := range jobs {
+		if s := m.GetSub(wj.SubId); s != nil {
+			if rec, isin := s.TaskRecord(wj.JobId); isin {
+				items = append(items, rec)
+			}
+		}
+	}
+	sort.Sort(items)
+	return items
+}
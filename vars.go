@@ -22,7 +22,11 @@ package main
 import (
 	"github.com/dlintw/goconf"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -35,6 +39,37 @@ var iomonitors = 2
 var useTls bool = true
 var certpath string = ""
 var certorg string = "golem.googlecode.com"
+var priorityAging = 60
+var fairShareWeight = 10
+var fairShareHalfLife = 3600
+var fairShareDefault = 1
+var ownerShares = map[string]int{}
+var reconnectGrace = 60
+var retryElsewhere = false
+var defaultRetryPolicy = RetryPolicy{MaxAttempts: 1, Backoff: 30, AvoidFailedNode: &retryElsewhere}
+var maxRetryBackoff = time.Hour
+var workerCores = runtime.NumCPU()
+var workerMemory = 0
+var workerLabels = []string{}
+var preferenceWeight = 10
+var reserveAfter = 300
+var journalPath = "golem.journal"
+var journalCompactSize = 64
+var leasePath = ""
+var leaseTimeout = 30
+var failoverTimeout = 120
+var blobDir = "blobs"
+var stageDir = filepath.Join(os.TempDir(), "golem")
+var killGrace = 10
+var checkinInterval = 60
+var missedCheckins = 3
+var minFreeMemory = 0
+var minFreeDisk = 0
+var nodeIdFile = "golem.nodeid"
+var minProtocolVersion = 1
+var prerequisiteWait = 3600
+var maxArchived = 1000
+var golemVersion = "dev" // set when linking with -X main.golemVersion
 
 // Sets global variable to enable TLS communications and other related variables (certificate path, organization)
 // optional parameters:  default.certpath, default.organization, default.tls
@@ -106,6 +141,236 @@ func IOMOnitors(config *goconf.ConfigFile) {
 	logger.Printf("iomonitors=[%v]", iomonitors)
 }
 
+// Sets global variable for how quickly waiting submissions gain priority, one point per priorityaging seconds (0 disables aging)
+// optional parameters:  master.priorityaging
+func PriorityAging(config *goconf.ConfigFile) {
+	aging, err := config.GetInt("master", "priorityaging")
+	if err != nil {
+		logger.Warn(err)
+	} else if aging >= 0 {
+		priorityAging = aging
+	}
+	logger.Printf("priorityaging=[%v]", priorityAging)
+}
+
+// Sets global variables for fair share scheduling between job owners.  fairshareweight is in points of job
+// priority: fair share moves a job by fewer than that many priority levels, a larger difference in priority wins.
+// optional parameters:  master.shares (owner:shares,owner:shares), master.defaultshares, master.fairshareweight, master.fairsharehalflife
+func FairShareConfig(config *goconf.ConfigFile) {
+	if weight, err := config.GetInt("master", "fairshareweight"); err != nil {
+		logger.Warn(err)
+	} else if weight >= 0 {
+		fairShareWeight = weight
+	}
+
+	if halflife, err := config.GetInt("master", "fairsharehalflife"); err != nil {
+		logger.Warn(err)
+	} else if halflife >= 0 {
+		fairShareHalfLife = halflife
+	}
+
+	if defaultShares, err := config.GetInt("master", "defaultshares"); err != nil {
+		logger.Warn(err)
+	} else if defaultShares > 0 {
+		fairShareDefault = defaultShares
+	}
+
+	if shares, err := config.GetString("master", "shares"); err != nil {
+		logger.Warn(err)
+	} else {
+		for _, entry := range strings.Split(shares, ",") {
+			pos := strings.LastIndex(entry, ":")
+			if pos < 0 {
+				logger.Printf("[CONFIG] ignoring share without owner:shares [%v]", entry)
+				continue
+			}
+			share, err := strconv.Atoi(strings.TrimSpace(entry[pos+1:]))
+			if err != nil || share < 0 {
+				logger.Printf("[CONFIG] ignoring invalid share [%v]", entry)
+				continue
+			}
+			ownerShares[strings.TrimSpace(entry[:pos])] = share
+		}
+	}
+	logger.Printf("fairshare=[weight=%v, halflife=%v, default=%v, shares=%v]", fairShareWeight, fairShareHalfLife, fairShareDefault, ownerShares)
+}
+
+// the number of shares configured for an owner, or the default
+func OwnerShares(owner string) int {
+	if share, isin := ownerShares[owner]; isin {
+		return share
+	}
+	return fairShareDefault
+}
+
+// Sets global default retry policy for submissions that don't specify one in their headers
+// optional parameters:  master.maxattempts, master.retrybackoff, master.retryelsewhere
+func RetryDefaults(config *goconf.ConfigFile) {
+	if attempts, err := config.GetInt("master", "maxattempts"); err != nil {
+		logger.Warn(err)
+	} else if attempts > 0 {
+		defaultRetryPolicy.MaxAttempts = attempts
+	}
+
+	if backoff, err := config.GetInt("master", "retrybackoff"); err != nil {
+		logger.Warn(err)
+	} else if backoff >= 0 {
+		defaultRetryPolicy.Backoff = backoff
+	}
+
+	if elsewhere, err := config.GetBool("master", "retryelsewhere"); err != nil {
+		logger.Warn(err)
+	} else {
+		retryElsewhere = elsewhere
+	}
+	logger.Printf("retry=[%v %v %v]", defaultRetryPolicy.MaxAttempts, defaultRetryPolicy.Backoff, retryElsewhere)
+}
+
+// Sets global variable for how long the master holds a disconnected node's tasks before requeueing them
+// optional parameters:  master.reconnectgrace
+func ReconnectGrace(config *goconf.ConfigFile) {
+	grace, err := config.GetInt("master", "reconnectgrace")
+	if err != nil {
+		logger.Warn(err)
+	} else if grace >= 0 {
+		reconnectGrace = grace
+	}
+	logger.Printf("reconnectgrace=[%v]", reconnectGrace)
+}
+
+// Sets global variables for the cores and MB of memory a worker reports to the master, by default what the machine has
+// optional parameters:  worker.cores, worker.memory
+func WorkerResources(config *goconf.ConfigFile) {
+	cores, err := config.GetInt("worker", "cores")
+	if err != nil {
+		logger.Warn(err)
+	} else if cores > 0 {
+		workerCores = cores
+	}
+
+	workerMemory = MemInfoMB("MemTotal")
+	memory, err := config.GetInt("worker", "memory")
+	if err != nil {
+		logger.Warn(err)
+	} else if memory > 0 {
+		workerMemory = memory
+	}
+	logger.Printf("cores=[%v] memory=[%v]", workerCores, workerMemory)
+}
+
+// Sets global variable for the labels a worker reports, which jobs can require or prefer
+// optional parameters:  worker.labels (comma separated, e.g. genome=hg38,matlab)
+func WorkerLabels(config *goconf.ConfigFile) {
+	labels, err := config.GetString("worker", "labels")
+	if err != nil {
+		logger.Warn(err)
+	} else {
+		workerLabels = ParseLabels(labels)
+	}
+	logger.Printf("labels=[%v]", workerLabels)
+}
+
+// Sets global variable for how many points each preferred label a node has adds to a job's score there
+// optional parameters:  master.preferenceweight
+func PreferenceWeight(config *goconf.ConfigFile) {
+	weight, err := config.GetInt("master", "preferenceweight")
+	if err != nil {
+		logger.Warn(err)
+	} else if weight >= 0 {
+		preferenceWeight = weight
+	}
+	logger.Printf("preferenceweight=[%v]", preferenceWeight)
+}
+
+// Sets global variable for how many seconds a task waits for room on a node before nodes that could run it stop
+// taking smaller tasks from lower scoring jobs, 0 never reserves nodes
+// optional parameters:  master.reserveafter
+func ReserveAfter(config *goconf.ConfigFile) {
+	after, err := config.GetInt("master", "reserveafter")
+	if err != nil {
+		logger.Warn(err)
+	} else if after >= 0 {
+		reserveAfter = after
+	}
+	logger.Printf("reserveafter=[%v]", reserveAfter)
+}
+
+// Sets global variables for the file the master journals its submissions to, an empty value turns journaling off,
+// and the size in MB past which it is compacted while the master runs, 0 only compacts it on startup
+// optional parameters:  master.journal, master.journalcompactsize
+func JournalPath(config *goconf.ConfigFile) {
+	path, err := config.GetString("master", "journal")
+	if err != nil {
+		logger.Warn(err)
+	} else {
+		journalPath = strings.TrimSpace(path)
+	}
+
+	size, err := config.GetInt("master", "journalcompactsize")
+	if err != nil {
+		logger.Warn(err)
+	} else if size >= 0 {
+		journalCompactSize = size
+	}
+	logger.Printf("journal=[%v] journalcompactsize=[%v]", journalPath, journalCompactSize)
+}
+
+// Sets global variables for running an active master with standbys, which share a lease file (and the journal)
+// in a shared directory.  without a lease file the master runs on its own.
+// optional parameters:  master.lease, master.leasetimeout
+func MasterLease(config *goconf.ConfigFile) {
+	path, err := config.GetString("master", "lease")
+	if err != nil {
+		logger.Warn(err)
+	} else {
+		leasePath = strings.TrimSpace(path)
+	}
+
+	timeout, err := config.GetInt("master", "leasetimeout")
+	if err != nil {
+		logger.Warn(err)
+	} else if timeout > 0 {
+		leaseTimeout = timeout
+	}
+	logger.Printf("lease=[%v] leasetimeout=[%v]", leasePath, leaseTimeout)
+}
+
+// Sets global variable for how many seconds a worker keeps trying its masters after losing its connection
+// optional parameters:  worker.failovertimeout
+func FailoverTimeout(config *goconf.ConfigFile) {
+	timeout, err := config.GetInt("worker", "failovertimeout")
+	if err != nil {
+		logger.Warn(err)
+	} else if timeout > 0 {
+		failoverTimeout = timeout
+	}
+	logger.Printf("failovertimeout=[%v]", failoverTimeout)
+}
+
+// Sets global variable for the directory the master keeps uploaded blobs in
+// optional parameters:  master.blobdir
+func BlobDir(config *goconf.ConfigFile) {
+	dir, err := config.GetString("master", "blobdir")
+	if err != nil {
+		logger.Warn(err)
+	} else if dir = strings.TrimSpace(dir); dir != "" {
+		blobDir = dir
+	}
+	logger.Printf("blobdir=[%v]", blobDir)
+}
+
+// Sets global variable for the directory a worker caches blobs and makes task directories in
+// optional parameters:  worker.stagedir
+func StageDir(config *goconf.ConfigFile) {
+	dir, err := config.GetString("worker", "stagedir")
+	if err != nil {
+		logger.Warn(err)
+	} else if dir = strings.TrimSpace(dir); dir != "" {
+		stageDir = dir
+	}
+	logger.Printf("stagedir=[%v]", stageDir)
+}
+
 //get the number of processors to use for golem itself
 func GoMaxProc(section string, config *goconf.ConfigFile) {
 	gomaxproc, err := config.GetInt(section, "gomaxproc")
@@ -125,3 +390,90 @@ func GetRequiredString(config *goconf.ConfigFile, section string, key string) (v
 	}
 	return
 }
+
+// Sets global variable for how long a killed task has to exit after SIGTERM before it gets SIGKILL
+// optional parameters:  worker.killgrace
+func KillGrace(config *goconf.ConfigFile) {
+	grace, err := config.GetInt("worker", "killgrace")
+	if err != nil {
+		logger.Warn(err)
+	} else if grace >= 0 {
+		killGrace = grace
+	}
+	logger.Printf("killgrace=[%v]", killGrace)
+}
+
+// Sets global variable for how many checkins in a row a worker can miss before the master gives up on it
+// optional parameters:  master.missedcheckins
+func MissedCheckins(config *goconf.ConfigFile) {
+	missed, err := config.GetInt("master", "missedcheckins")
+	if err != nil {
+		logger.Warn(err)
+	} else if missed > 0 {
+		missedCheckins = missed
+	}
+	logger.Printf("missedcheckins=[%v]", missedCheckins)
+}
+
+// Sets global variables for the free memory and scratch disk, in MB, a worker must report to be given new tasks
+// optional parameters:  master.minfreememory, master.minfreedisk
+func MinFreeResources(config *goconf.ConfigFile) {
+	memory, err := config.GetInt("master", "minfreememory")
+	if err != nil {
+		logger.Warn(err)
+	} else if memory >= 0 {
+		minFreeMemory = memory
+	}
+
+	disk, err := config.GetInt("master", "minfreedisk")
+	if err != nil {
+		logger.Warn(err)
+	} else if disk >= 0 {
+		minFreeDisk = disk
+	}
+	logger.Printf("minfreememory=[%v] minfreedisk=[%v]", minFreeMemory, minFreeDisk)
+}
+
+// Sets global variable for the file a worker keeps its node id in, so it keeps the same id across restarts
+// optional parameters:  worker.nodeidfile
+func NodeIdFile(config *goconf.ConfigFile) {
+	path, err := config.GetString("worker", "nodeidfile")
+	if err != nil {
+		logger.Warn(err)
+	} else if path = strings.TrimSpace(path); path != "" {
+		nodeIdFile = path
+	}
+	logger.Printf("nodeidfile=[%v]", nodeIdFile)
+}
+
+// Sets global variable for the oldest protocol version a worker can speak and still be let in
+// optional parameters:  master.minprotocolversion
+func MinProtocolVersion(config *goconf.ConfigFile) {
+	version, err := config.GetInt("master", "minprotocolversion")
+	if err != nil {
+		logger.Warn(err)
+	} else if version > 0 {
+		minProtocolVersion = version
+	}
+	logger.Printf("minprotocolversion=[%v] protocolversion=[%v]", minProtocolVersion, protocolVersion)
+}
+
+// Sets global variables for how long a job waits on a prerequisite the master has never seen before it is
+// cancelled, and how many archived jobs are remembered for jobs that depend on them
+// optional parameters:  master.prerequisitewait, master.maxarchived
+func PrerequisiteLimits(config *goconf.ConfigFile) {
+	wait, err := config.GetInt("master", "prerequisitewait")
+	if err != nil {
+		logger.Warn(err)
+	} else if wait > 0 {
+		prerequisiteWait = wait
+	}
+
+	archived, err := config.GetInt("master", "maxarchived")
+	if err != nil {
+		logger.Warn(err)
+	} else if archived > 0 {
+		maxArchived = archived
+	}
+	logger.Printf("prerequisitewait=[%v] maxarchived=[%v]", prerequisiteWait, maxArchived)
+}